@@ -43,6 +43,7 @@ type sessionPageInfo struct {
 	SessionID string
 	Title     string
 	Text      string
+	Flashes   []string
 }
 
 // Authenticate the Basic Auth credentials.
@@ -62,21 +63,23 @@ func sessionPageRenderer(w handlers.GhostWriter, r *http.Request) {
 	)
 
 	ssn := w.Session()
-	if r.Method == "GET" {
-		txt = ssn.Data[sessionPageKey]
-	} else {
-		txt = r.FormValue(sessionPageKey)
-		ssn.Data[sessionPageKey] = txt
+	if r.Method != "GET" {
+		// Save the value and redirect to the page (post/redirect/get)
+		ssn.Set(sessionPageKey, r.FormValue(sessionPageKey))
+		w.AddFlash("info", "Value saved to session")
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
 	}
+	txt = ssn.Get(sessionPageKey)
 	if r.URL.Path == "/session/auth" {
 		title = sessionPageAuthTitle
 	} else {
 		title = sessionPageTitle
 	}
 	if txt != nil {
-		data = sessionPageInfo{ssn.ID(), title, txt.(string)}
+		data = sessionPageInfo{ssn.ID(), title, txt.(string), w.Flashes("info")}
 	} else {
-		data = sessionPageInfo{ssn.ID(), title, "[nil]"}
+		data = sessionPageInfo{ssn.ID(), title, "[nil]", w.Flashes("info")}
 	}
 	err := templates.Render("templates/session.tmpl", w, data)
 	if err != nil {
@@ -117,6 +120,7 @@ func main() {
 
 	// Set the more complex routes for session handling and dynamic page (same
 	// handler is used for both GET and POST).
+	defer memStore.Close()
 	ssnOpts := handlers.NewSessionOptions(memStore, secret)
 	ssnOpts.CookieTemplate.MaxAge = sessionExpiration
 	hSsn := handlers.SessionHandler(
@@ -0,0 +1,331 @@
+package handlers
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCacheMaxLen = 1000
+	defaultCacheTTL    = 5 * time.Second
+)
+
+var ErrNoBackingStore = errors.New("cache store backing store is missing")
+
+type CacheStoreOptions struct {
+	Store  SessionStore    // Required, the backing store (i.e. a RedisStore)
+	MaxLen int             // Max number of cached sessions, the least recently used are evicted, defaults to 1000
+	TTL    time.Duration   // Time to live of the cached sessions, defaults to 5 seconds
+	Notify func(id string) // If set, called after a session is saved or deleted by this store ("" when cleared)
+}
+
+// Two-tier session store, that keeps a small in-memory cache of the sessions in front
+// of a backing store. Sessions are read from the cache if they were cached for less
+// than the TTL, saves are written through to the backing store, and deletes invalidate
+// the cache. With multiple nodes, a session saved by another node may be read stale
+// from the cache until the TTL expires, unless the nodes invalidate each other's
+// cache: the Notify option can publish the saved session IDs (e.g. using Redis
+// pub/sub), and the other nodes call Invalidate when they receive them.
+type CacheStore struct {
+	l    sync.Mutex
+	opts *CacheStoreOptions
+	m    map[string]*list.Element
+	lru  *list.List // Most recently used at the front
+}
+
+// Create a cache store in front of the backing store of the options.
+func NewCacheStore(opts *CacheStoreOptions) (*CacheStore, error) {
+	if opts.Store == nil {
+		return nil, ErrNoBackingStore
+	}
+	if opts.MaxLen <= 0 {
+		opts.MaxLen = defaultCacheMaxLen
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = defaultCacheTTL
+	}
+	cs := &CacheStore{opts: opts}
+	cs.newMap()
+	return cs, nil
+}
+
+// Get the session from the cache, or from the backing store if it is not cached.
+func (this *CacheStore) Get(id string) (*Session, error) {
+	return this.GetContext(context.Background(), id)
+}
+
+// Get the session from the cache, or from the backing store if it is not cached,
+// using the context if the backing store supports it. The error of the context is
+// returned if it is done, even if the session is cached.
+func (this *CacheStore) GetContext(ctx context.Context, id string) (*Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if sess := this.get(id); sess != nil {
+		return sess, nil
+	}
+	sess, err := getSession(ctx, this.opts.Store, id)
+	if err != nil || sess == nil {
+		return nil, err
+	}
+	this.put(sess)
+	return sess, nil
+}
+
+// Save the session into the backing store, and cache it.
+func (this *CacheStore) Set(sess *Session) error {
+	return this.SetContext(context.Background(), sess)
+}
+
+// Save the session into the backing store, and cache it, using the context if the
+// backing store supports it. The error of the context is returned if it is done.
+func (this *CacheStore) SetContext(ctx context.Context, sess *Session) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := setSession(ctx, this.opts.Store, sess); err != nil {
+		// The backing store may or may not be modified
+		this.Invalidate(sess.ID())
+		return err
+	}
+	this.put(sess)
+	this.notify(sess.ID())
+	return nil
+}
+
+// Save the session into the backing store if the version of the stored session is
+// the specified version. If the backing store does not support optimistic concurrency,
+// the session is not saved and ErrCompareAndSetUnsupported is returned.
+func (this *CacheStore) CompareAndSet(sess *Session, version int64) (bool, error) {
+	return this.CompareAndSetContext(context.Background(), sess, version)
+}
+
+// Save the session into the backing store if the version of the stored session is
+// the specified version, using the context if the backing store supports it.
+func (this *CacheStore) CompareAndSetContext(ctx context.Context, sess *Session, version int64) (bool, error) {
+	cas, ok := this.opts.Store.(SessionCompareAndSetter)
+	if !ok {
+		return false, ErrCompareAndSetUnsupported
+	}
+	ok, err := compareAndSetSession(ctx, cas, sess, version)
+	if err != nil || !ok {
+		// The cached session is stale
+		this.Invalidate(sess.ID())
+		return ok, err
+	}
+	this.put(sess)
+	this.notify(sess.ID())
+	return true, nil
+}
+
+// Save the session into the backing store if id is in the backing store, and delete
+// id if it is not the ID of the session.
+func (this *CacheStore) Replace(sess *Session, id string) (bool, error) {
+	return this.ReplaceContext(context.Background(), sess, id)
+}
+
+// Save the session into the backing store if id is in the backing store, and delete
+// id if it is not the ID of the session, using the context if the backing store
+// supports it.
+func (this *CacheStore) ReplaceContext(ctx context.Context, sess *Session, id string) (bool, error) {
+	this.Invalidate(id)
+	if err := replaceSession(ctx, this.opts.Store, sess, id); err != nil {
+		this.Invalidate(sess.ID())
+		if err == ErrSessionGone {
+			return false, nil
+		}
+		return false, err
+	}
+	this.put(sess)
+	if id != sess.ID() {
+		this.notify(id)
+	}
+	this.notify(sess.ID())
+	return true, nil
+}
+
+// Reset the expiration and save the last access time of the session in the backing
+// store, and in the cache.
+func (this *CacheStore) Touch(sess *Session) error {
+	return this.TouchContext(context.Background(), sess)
+}
+
+// Reset the expiration and save the last access time of the session in the backing
+// store, and in the cache, using the context if the backing store supports it.
+func (this *CacheStore) TouchContext(ctx context.Context, sess *Session) error {
+	if err := touchSession(ctx, this.opts.Store, sess); err != nil {
+		return err
+	}
+	this.l.Lock()
+	defer this.l.Unlock()
+	if el, ok := this.m[sess.ID()]; ok {
+		el.Value.(*memoryEntry).sess.internalSession.LastAccess = sess.internalSession.LastAccess
+	}
+	return nil
+}
+
+// Delete the session from the cache and the backing store.
+func (this *CacheStore) Delete(id string) error {
+	return this.DeleteContext(context.Background(), id)
+}
+
+// Delete the session from the cache and the backing store, using the context if
+// the backing store supports it. The error of the context is returned if it is done.
+func (this *CacheStore) DeleteContext(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	this.Invalidate(id)
+	if err := deleteSession(ctx, this.opts.Store, id); err != nil {
+		return err
+	}
+	this.notify(id)
+	return nil
+}
+
+// Clear all sessions from the cache and the backing store.
+func (this *CacheStore) Clear() error {
+	this.InvalidateAll()
+	if err := this.opts.Store.Clear(); err != nil {
+		return err
+	}
+	this.notify("")
+	return nil
+}
+
+// Get the number of sessions in the backing store.
+func (this *CacheStore) Len() int {
+	return this.opts.Store.Len()
+}
+
+// Associate the session ID with the owner in the backing store, if it implements
+// SessionIndexer.
+func (this *CacheStore) Associate(owner, id string) error {
+	idx, ok := this.opts.Store.(SessionIndexer)
+	if !ok {
+		return ErrSessionIndexUnsupported
+	}
+	return idx.Associate(owner, id)
+}
+
+// Check if the session ID is associated with the owner in the backing store, if it
+// implements SessionIndexer.
+func (this *CacheStore) IsOwner(owner, id string) (bool, error) {
+	idx, ok := this.opts.Store.(SessionIndexer)
+	if !ok {
+		return false, ErrSessionIndexUnsupported
+	}
+	return idx.IsOwner(owner, id)
+}
+
+// Get the IDs of the sessions of the owner from the backing store, if it implements
+// SessionIndexer.
+func (this *CacheStore) OwnerSessions(owner string) ([]string, error) {
+	idx, ok := this.opts.Store.(SessionIndexer)
+	if !ok {
+		return nil, ErrSessionIndexUnsupported
+	}
+	return idx.OwnerSessions(owner)
+}
+
+// Delete all sessions of the owner from the cache and the backing store, if it
+// implements SessionIndexer.
+func (this *CacheStore) DeleteOwnerSessions(owner string) error {
+	idx, ok := this.opts.Store.(SessionIndexer)
+	if !ok {
+		return ErrSessionIndexUnsupported
+	}
+	ids, err := idx.OwnerSessions(owner)
+	if err != nil {
+		return err
+	}
+	if err = idx.DeleteOwnerSessions(owner); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		this.Invalidate(id)
+		this.notify(id)
+	}
+	return nil
+}
+
+// Remove the session from the cache, so that it is read again from the backing
+// store. It should be called when the session is saved or deleted by another node.
+func (this *CacheStore) Invalidate(id string) {
+	this.l.Lock()
+	defer this.l.Unlock()
+	if el, ok := this.m[id]; ok {
+		this.remove(el)
+	}
+}
+
+// Remove all sessions from the cache.
+func (this *CacheStore) InvalidateAll() {
+	this.l.Lock()
+	defer this.l.Unlock()
+	this.newMap()
+}
+
+// Get a copy of the cached session, or nil if it is not cached or expired.
+func (this *CacheStore) get(id string) *Session {
+	this.l.Lock()
+	defer this.l.Unlock()
+	el, ok := this.m[id]
+	if !ok {
+		return nil
+	}
+	ent := el.Value.(*memoryEntry)
+	if time.Now().After(ent.exp) {
+		this.remove(el)
+		return nil
+	}
+	this.lru.MoveToFront(el)
+	return ent.sess.clone()
+}
+
+// Cache a copy of the session, evicting the least recently used sessions if the
+// cache is full. The session is cached for the TTL, or less if it expires before.
+func (this *CacheStore) put(sess *Session) {
+	ttl := this.opts.TTL
+	if ma := sess.MaxAge(); ma > 0 && ma < ttl {
+		ttl = ma
+	}
+	sess = sess.clone()
+	sess.isNew = false
+	exp := time.Now().Add(ttl)
+
+	this.l.Lock()
+	defer this.l.Unlock()
+	if el, ok := this.m[sess.ID()]; ok {
+		ent := el.Value.(*memoryEntry)
+		ent.sess, ent.exp = sess, exp
+		this.lru.MoveToFront(el)
+		return
+	}
+	this.m[sess.ID()] = this.lru.PushFront(&memoryEntry{sess.ID(), sess, exp})
+	for this.lru.Len() > this.opts.MaxLen {
+		this.remove(this.lru.Back())
+	}
+}
+
+// Call the Notify option, if set.
+func (this *CacheStore) notify(id string) {
+	if this.opts.Notify != nil {
+		this.opts.Notify(id)
+	}
+}
+
+// Remove the entry from the cache. The lock must be held by the caller.
+func (this *CacheStore) remove(el *list.Element) {
+	this.lru.Remove(el)
+	delete(this.m, el.Value.(*memoryEntry).id)
+}
+
+// Re-create the internal map, dropping all cached sessions.
+func (this *CacheStore) newMap() {
+	this.m = make(map[string]*list.Element, this.opts.MaxLen)
+	this.lru = list.New()
+}
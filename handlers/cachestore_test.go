@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// A backing store that counts the number of sessions read.
+type readCountingStore struct {
+	*MemoryStore
+	gets int
+}
+
+func (this *readCountingStore) Get(id string) (*Session, error) {
+	this.gets++
+	return this.MemoryStore.Get(id)
+}
+
+func TestCacheStore(t *testing.T) {
+	bs := &readCountingStore{MemoryStore: NewMemoryStore(1)}
+	defer bs.Close()
+	var notified []string
+	cs, err := NewCacheStore(&CacheStoreOptions{
+		Store:  bs,
+		TTL:    20 * time.Millisecond,
+		Notify: func(id string) { notified = append(notified, id) },
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	ssn := newSession(0)
+	ssn.Set("foo", "bar")
+	cs.Set(ssn)
+	assertTrue(bs.MemoryStore.Len() == 1, "expected session to be written through", t)
+
+	// Read from the cache
+	for i := 0; i < 3; i++ {
+		got, _ := cs.Get(ssn.ID())
+		assertTrue(got != nil && got.Get("foo") == "bar", fmt.Sprintf("expected cached session, got %v", got), t)
+	}
+	assertTrue(bs.gets == 0, fmt.Sprintf("expected no read of the backing store, got %d", bs.gets), t)
+
+	// Read from the backing store once the TTL expires, then cached again
+	time.Sleep(30 * time.Millisecond)
+	cs.Get(ssn.ID())
+	cs.Get(ssn.ID())
+	assertTrue(bs.gets == 1, fmt.Sprintf("expected 1 read of the backing store, got %d", bs.gets), t)
+
+	// Saved by another node, invalidated by the hook
+	other := ssn.clone()
+	other.Set("foo", "baz")
+	bs.Set(other)
+	got, _ := cs.Get(ssn.ID())
+	assertTrue(got.Get("foo") == "bar", fmt.Sprintf("expected stale cached session, got %v", got.Get("foo")), t)
+	cs.Invalidate(ssn.ID())
+	got, _ = cs.Get(ssn.ID())
+	assertTrue(got.Get("foo") == "baz", fmt.Sprintf("expected updated session, got %v", got.Get("foo")), t)
+
+	// Delete invalidates the cache
+	cs.Delete(ssn.ID())
+	got, _ = cs.Get(ssn.ID())
+	assertTrue(got == nil, "expected deleted session to be nil", t)
+	assertTrue(len(notified) == 2 && notified[0] == ssn.ID() && notified[1] == ssn.ID(),
+		fmt.Sprintf("expected 2 notifications, got %v", notified), t)
+
+	// Clear invalidates the cache
+	cs.Set(ssn)
+	cs.Clear()
+	got, _ = cs.Get(ssn.ID())
+	assertTrue(got == nil, "expected cleared session to be nil", t)
+	assertTrue(cs.Len() == 0, fmt.Sprintf("expected empty store, got %d", cs.Len()), t)
+}
+
+func TestCacheStoreEviction(t *testing.T) {
+	bs := &readCountingStore{MemoryStore: NewMemoryStore(1)}
+	defer bs.Close()
+	cs, _ := NewCacheStore(&CacheStoreOptions{Store: bs, MaxLen: 1})
+
+	s1, s2 := newSession(0), newSession(0)
+	cs.Set(s1)
+	cs.Set(s2)
+	cs.Get(s2.ID())
+	assertTrue(bs.gets == 0, fmt.Sprintf("expected most recent session to be cached, got %d reads", bs.gets), t)
+	cs.Get(s1.ID())
+	assertTrue(bs.gets == 1, fmt.Sprintf("expected evicted session to be read, got %d reads", bs.gets), t)
+}
+
+func TestCacheStoreNoBackingStore(t *testing.T) {
+	_, err := NewCacheStore(&CacheStoreOptions{})
+	assertTrue(err == ErrNoBackingStore, fmt.Sprintf("expected ErrNoBackingStore, got %v", err), t)
+}
+
+func TestCacheStoreNoCompareAndSet(t *testing.T) {
+	ms := NewMemoryStore(1)
+	defer ms.Close()
+	// Hide the optional methods of the memory store
+	bs := struct{ SessionStore }{ms}
+	cs, _ := NewCacheStore(&CacheStoreOptions{Store: bs})
+
+	ssn := newSession(0)
+	ok, err := cs.CompareAndSet(ssn, 0)
+	assertTrue(!ok && err == ErrCompareAndSetUnsupported, fmt.Sprintf("expected ErrCompareAndSetUnsupported, got %t, %v", ok, err), t)
+	assertTrue(ms.Len() == 0, fmt.Sprintf("expected the session not to be saved, got %d", ms.Len()), t)
+
+	// The handler saves the session without optimistic concurrency
+	err = saveSession(context.Background(), &SessionOptions{Store: cs, ConflictPolicy: ConflictFail}, ssn, 0)
+	assertTrue(err == nil, fmt.Sprintf("expected no error, got %v", err), t)
+	assertTrue(ms.Len() == 1, fmt.Sprintf("expected the session to be saved, got %d", ms.Len()), t)
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+)
+
+// SessionCodec encodes and decodes sessions. It is used by the stores that
+// persist the session as bytes, and by the SessionHandler to detect changes
+// to the session.
+type SessionCodec interface {
+	Encode(sess *Session) ([]byte, error)
+	Decode(b []byte) (*Session, error)
+}
+
+// JSONCodec encodes the sessions using encoding/json. This is the default codec.
+// Numbers in the session data are decoded as float64, and structs as
+// map[string]interface{}.
+type JSONCodec struct{}
+
+// Encode the session to JSON.
+func (this JSONCodec) Encode(sess *Session) ([]byte, error) {
+	return json.Marshal(sess)
+}
+
+// Decode the session from JSON.
+func (this JSONCodec) Decode(b []byte) (*Session, error) {
+	var sess Session
+	err := json.Unmarshal(b, &sess)
+	if err != nil {
+		return nil, err
+	}
+	return &sess, nil
+}
+
+// GobCodec encodes the sessions using encoding/gob. The types of the session data
+// are kept, but the custom types must be registered with gob.Register. The keys of
+// the data map are sorted, but gob encodes the maps nested in the values in random
+// order: with SessionOptions.HashModified, the values must not contain maps, or an
+// unchanged session may be reported as modified and saved. The JSONCodec sorts the
+// keys of all maps.
+type GobCodec struct{}
+
+// Encode the session to gob.
+func (this GobCodec) Encode(sess *Session) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(sess)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode the session from gob.
+func (this GobCodec) Decode(b []byte) (*Session, error) {
+	var sess Session
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&sess)
+	if err != nil {
+		return nil, err
+	}
+	return &sess, nil
+}
+
+// Get the specified codec, or the default JSON codec if it is nil.
+func getCodec(c SessionCodec) SessionCodec {
+	if c == nil {
+		return JSONCodec{}
+	}
+	return c
+}
@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"encoding/gob"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type codecTestValue struct {
+	Name string
+	N    int
+}
+
+func init() {
+	gob.Register(codecTestValue{})
+}
+
+func TestJSONCodec(t *testing.T) {
+	ssn := newSession(10)
+	ssn.Data["int"] = 3
+	c := JSONCodec{}
+	b, err := c.Encode(ssn)
+	if err != nil {
+		panic(err)
+	}
+	ssn2, err := c.Decode(b)
+	if err != nil {
+		panic(err)
+	}
+	assertTrue(ssn2.ID() == ssn.ID(), fmt.Sprintf("expected session ID to be %s, got %s", ssn.ID(), ssn2.ID()), t)
+	assertTrue(ssn2.Data["int"] == float64(3), fmt.Sprintf("expected ssn[int] to be float64 3, got %#v", ssn2.Data["int"]), t)
+}
+
+func TestGobCodec(t *testing.T) {
+	ssn := newSession(10)
+	ssn.Data["int"] = 3
+	ssn.Data["struct"] = codecTestValue{"a", 1}
+	ssn.Data["nil"] = nil
+	c := GobCodec{}
+	b, err := c.Encode(ssn)
+	if err != nil {
+		panic(err)
+	}
+	ssn2, err := c.Decode(b)
+	if err != nil {
+		panic(err)
+	}
+	assertTrue(ssn2.ID() == ssn.ID(), fmt.Sprintf("expected session ID to be %s, got %s", ssn.ID(), ssn2.ID()), t)
+	assertTrue(ssn2.MaxAge() == 10*time.Second, fmt.Sprintf("expected max age to be 10s, got %s", ssn2.MaxAge()), t)
+	assertTrue(ssn2.Created().Equal(ssn.Created()), fmt.Sprintf("expected created to be %s, got %s", ssn.Created(), ssn2.Created()), t)
+	assertTrue(ssn2.Data["int"] == 3, fmt.Sprintf("expected ssn[int] to be int 3, got %#v", ssn2.Data["int"]), t)
+	assertTrue(ssn2.Data["struct"] == codecTestValue{"a", 1}, fmt.Sprintf("expected ssn[struct] to be {a 1}, got %#v", ssn2.Data["struct"]), t)
+	v, ok := ssn2.Data["nil"]
+	assertTrue(ok && v == nil, fmt.Sprintf("expected ssn[nil] to be nil, got %#v", v), t)
+}
+
+func TestGobCodecHash(t *testing.T) {
+	ssn := newSession(10)
+	for i := 0; i < 20; i++ {
+		ssn.Data[fmt.Sprintf("k%d", i)] = i
+	}
+	c := GobCodec{}
+	h := hash(c, ssn)
+	for i := 0; i < 10; i++ {
+		assertTrue(hash(c, ssn) == h, "expected gob hash to be the same for the same session", t)
+	}
+	ssn.Data["k0"] = -1
+	assertTrue(hash(c, ssn) != h, "expected gob hash to be different for a modified session", t)
+}
+
+func TestJSONCodecHashNestedMap(t *testing.T) {
+	ssn := newSession(10)
+	nested := make(map[string]interface{})
+	for i := 0; i < 20; i++ {
+		nested[fmt.Sprintf("k%d", i)] = i
+	}
+	ssn.Data["nested"] = nested
+	c := JSONCodec{}
+	h := hash(c, ssn)
+	for i := 0; i < 10; i++ {
+		assertTrue(hash(c, ssn) == h, "expected JSON hash to be the same for the same nested map", t)
+	}
+	nested["k0"] = -1
+	assertTrue(hash(c, ssn) != h, "expected JSON hash to be different for a modified nested map", t)
+}
@@ -0,0 +1,84 @@
+package handlers_test
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/PuerkitoBio/ghost/handlers"
+	"github.com/PuerkitoBio/ghost/handlers/internal/redisstub"
+	"github.com/PuerkitoBio/ghost/handlers/storetest"
+)
+
+func TestMemoryStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) handlers.SessionStore {
+		ms := handlers.NewMemoryStore(1)
+		t.Cleanup(func() { ms.Close() })
+		return ms
+	})
+}
+
+func TestRedisStoreConformance(t *testing.T) {
+	srv, err := redisstub.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	storetest.Run(t, func(t *testing.T) handlers.SessionStore {
+		rs, err := handlers.NewRedisStore(&handlers.RedisStoreOptions{
+			Network:   "tcp",
+			Address:   srv.Addr(),
+			Database:  1,
+			KeyPrefix: "sess",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			rs.Clear()
+			rs.Close()
+		})
+		return rs
+	})
+}
+
+func TestFileStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) handlers.SessionStore {
+		fs, err := handlers.NewFileStore(&handlers.FileStoreOptions{Dir: t.TempDir()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { fs.Close() })
+		return fs
+	})
+}
+
+func TestSQLStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) handlers.SessionStore {
+		// The fake driver of the tests, each DSN is a separate database
+		db, err := sql.Open("ghostfake", "conformance/"+t.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ss, err := handlers.NewSQLStore(&handlers.SQLStoreOptions{DB: db})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ss.CreateTable(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return ss
+	})
+}
+
+func TestCacheStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) handlers.SessionStore {
+		ms := handlers.NewMemoryStore(1)
+		t.Cleanup(func() { ms.Close() })
+		cs, err := handlers.NewCacheStore(&handlers.CacheStoreOptions{Store: ms})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cs
+	})
+}
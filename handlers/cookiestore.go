@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+const defaultCookieMaxSize = 4096
+
+var (
+	ErrInvalidHashKey        = errors.New("cookie store hash key is missing")
+	ErrInvalidBlockKey       = errors.New("cookie store block key must be 16, 24 or 32 bytes long")
+	ErrSessionCookieTooLarge = errors.New("session data is too large to be saved in a cookie")
+	ErrSessionCookieExpired  = errors.New("session cookie is expired")
+)
+
+// SessionCookieWriter can be implemented by a SessionStore that keeps the session
+// in the session cookie itself, instead of the signed session ID. The SessionHandler
+// reads the session from the cookie value, and writes the session as cookie value
+// when the session is new or modified. Because the cookie is sent with the headers,
+// changes made to the session after the response is written are lost.
+type SessionCookieWriter interface {
+	ReadCookie(name, value string) (*Session, error)        // Get the session from the cookie value
+	WriteCookie(name string, sess *Session) (string, error) // Get the cookie value for the session
+}
+
+type CookieStoreOptions struct {
+	HashKey              []byte        // Required, authenticates the cookie value
+	BlockKey             []byte        // Required, encrypts the cookie value (AES-128, AES-192 or AES-256)
+	MaxSize              int           // Max size of the cookie name and value, defaults to 4096 bytes
+	BrowserSessServerTTL time.Duration // Defaults to 2 days
+	Codec                SessionCodec  // Encoding of the sessions, defaults to JSONCodec
+}
+
+// Client-side implementation of a session store. The whole session is saved
+// in the cookie, encrypted and authenticated, so nothing is kept on the server.
+// Get, Delete and Clear have nothing to do on the server side, and Len is not
+// supported (it returns -1). The Secret of the SessionOptions is not used, the
+// cookie is authenticated with the HashKey. Because nothing is kept on the server,
+// a session cannot be revoked: Destroy only expires the cookie of the client,
+// a copy of the cookie (e.g. a stolen or replayed one) stays valid until the
+// session expires (MaxAge, or BrowserSessServerTTL). Use a server-side store if
+// sessions must be revoked, or change the keys to revoke all of them.
+type CookieStore struct {
+	opts *CookieStoreOptions
+	sck  *securecookie.SecureCookie
+}
+
+// The data encoded in the cookie value.
+type cookiePayload struct {
+	Expires int64  // Unix time of the expiration of the session
+	Session []byte // Encoded session
+}
+
+// Create a cookie session store with the specified options.
+func NewCookieStore(opts *CookieStoreOptions) (*CookieStore, error) {
+	if len(opts.HashKey) == 0 {
+		return nil, ErrInvalidHashKey
+	}
+	switch len(opts.BlockKey) {
+	case 16, 24, 32:
+	default:
+		return nil, ErrInvalidBlockKey
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = defaultCookieMaxSize
+	}
+	// The expiration and the size are validated by the store
+	sck := securecookie.New(opts.HashKey, opts.BlockKey).MaxAge(0).MaxLength(0)
+	return &CookieStore{opts, sck}, nil
+}
+
+// Get the session from the encrypted cookie value.
+func (this *CookieStore) ReadCookie(name, value string) (*Session, error) {
+	var pl cookiePayload
+	err := this.sck.Decode(name, value, &pl)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().Unix() > pl.Expires {
+		return nil, ErrSessionCookieExpired
+	}
+	return getCodec(this.opts.Codec).Decode(pl.Session)
+}
+
+// Get the encrypted cookie value of the session. It returns ErrSessionCookieTooLarge
+// if the cookie would exceed the maximum size.
+func (this *CookieStore) WriteCookie(name string, sess *Session) (string, error) {
+	b, err := getCodec(this.opts.Codec).Encode(sess)
+	if err != nil {
+		return "", err
+	}
+	pl := cookiePayload{time.Now().Add(sessionTTL(sess, this.opts.BrowserSessServerTTL)).Unix(), b}
+	enc, err := this.sck.Encode(name, pl)
+	if err != nil {
+		return "", err
+	}
+	if len(name)+len(enc)+1 > this.opts.MaxSize {
+		return "", ErrSessionCookieTooLarge
+	}
+	return enc, nil
+}
+
+// Get the session from the store. The session is read from the cookie by the
+// SessionHandler, so this always returns nil.
+func (this *CookieStore) Get(id string) (*Session, error) {
+	return nil, nil
+}
+
+// Save the session into the store. The session is written to the cookie by the
+// SessionHandler, so there is nothing to do.
+func (this *CookieStore) Set(sess *Session) error {
+	return nil
+}
+
+// Save the session into the store if it is still in the store. The session is
+// written to the cookie by the SessionHandler, so there is nothing to do.
+func (this *CookieStore) Replace(sess *Session, id string) (bool, error) {
+	return true, nil
+}
+
+// Reset the expiration of the session. The expiration is written to the cookie
+// by the SessionHandler, so there is nothing to do.
+func (this *CookieStore) Touch(sess *Session) error {
+	return nil
+}
+
+// Delete the session from the store. The session cookie is expired by the
+// SessionHandler, so there is nothing to do.
+func (this *CookieStore) Delete(id string) error {
+	return nil
+}
+
+// Clear all sessions from the store. This is not possible for client-side
+// sessions, so there is nothing to do.
+func (this *CookieStore) Clear() error {
+	return nil
+}
+
+// Get the number of sessions in the store. Client-side sessions cannot be
+// counted, so this returns -1.
+func (this *CookieStore) Len() int {
+	return -1
+}
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var (
+	cookieHashKey  = []byte("when the levee breaks")
+	cookieBlockKey = []byte("0123456789abcdef")
+)
+
+func TestCookieStoreSession(t *testing.T) {
+	var err error
+	store, err = NewCookieStore(&CookieStoreOptions{
+		HashKey:  cookieHashKey,
+		BlockKey: cookieBlockKey,
+	})
+	if err != nil {
+		panic(err)
+	}
+	t.Log("SessionExists")
+	testSessionExists(t)
+	t.Log("SessionPersists")
+	testSessionPersists(t)
+	t.Log("SessionExpires")
+	testSessionExpires(t)
+	t.Log("SessionBeforeExpires")
+	testSessionBeforeExpires(t)
+	t.Log("SessionDestroy")
+	testSessionDestroy(t)
+}
+
+func TestCookieStoreInvalidKeys(t *testing.T) {
+	_, err := NewCookieStore(&CookieStoreOptions{BlockKey: cookieBlockKey})
+	assertTrue(err == ErrInvalidHashKey, fmt.Sprintf("expected error %s, got %v", ErrInvalidHashKey, err), t)
+	_, err = NewCookieStore(&CookieStoreOptions{HashKey: cookieHashKey, BlockKey: []byte("short")})
+	assertTrue(err == ErrInvalidBlockKey, fmt.Sprintf("expected error %s, got %v", ErrInvalidBlockKey, err), t)
+}
+
+func TestCookieStoreReadWrite(t *testing.T) {
+	cs, err := NewCookieStore(&CookieStoreOptions{
+		HashKey:  cookieHashKey,
+		BlockKey: cookieBlockKey,
+	})
+	if err != nil {
+		panic(err)
+	}
+	ssn := newSession(0)
+	ssn.Data["foo"] = "bar"
+	val, err := cs.WriteCookie(defaultCookieName, ssn)
+	if err != nil {
+		panic(err)
+	}
+	assertTrue(!strings.Contains(val, "bar"), "expected cookie value to be encrypted", t)
+
+	ssn2, err := cs.ReadCookie(defaultCookieName, val)
+	if err != nil {
+		panic(err)
+	}
+	assertTrue(ssn2.ID() == ssn.ID(), fmt.Sprintf("expected session ID to be %s, got %s", ssn.ID(), ssn2.ID()), t)
+	assertTrue(ssn2.Data["foo"] == "bar", fmt.Sprintf("expected ssn[foo] to be 'bar', got %v", ssn2.Data["foo"]), t)
+
+	_, err = cs.ReadCookie("other.name", val)
+	assertTrue(err != nil, "expected error reading cookie with another name, got nil", t)
+}
+
+func TestCookieStoreTooLarge(t *testing.T) {
+	cs, err := NewCookieStore(&CookieStoreOptions{
+		HashKey:  cookieHashKey,
+		BlockKey: cookieBlockKey,
+		MaxSize:  512,
+	})
+	if err != nil {
+		panic(err)
+	}
+	ssn := newSession(0)
+	ssn.Data["foo"] = strings.Repeat("a", 512)
+	_, err = cs.WriteCookie(defaultCookieName, ssn)
+	assertTrue(err == ErrSessionCookieTooLarge, fmt.Sprintf("expected error %s, got %v", ErrSessionCookieTooLarge, err), t)
+}
+
+func TestCookieStoreTooLargeOnError(t *testing.T) {
+	cs, err := NewCookieStore(&CookieStoreOptions{
+		HashKey:  cookieHashKey,
+		BlockKey: cookieBlockKey,
+		MaxSize:  512,
+	})
+	if err != nil {
+		panic(err)
+	}
+	var errs []error
+	opts := NewSessionOptions(cs, secret)
+	opts.OnError = func(w http.ResponseWriter, r *http.Request, err error) bool {
+		errs = append(errs, err)
+		return false
+	}
+	s := setupTestOpts(func(w http.ResponseWriter, r *http.Request) {
+		ssn, _ := GetSession(w)
+		ssn.Set("foo", strings.Repeat("a", 512))
+		w.Write([]byte("ok"))
+	}, opts)
+	defer s.Close()
+
+	res, _ := doRequestWithCookie(s.URL, nil)
+	assertTrue(len(res.Cookies()) == 0, fmt.Sprintf("expected no cookie, got %d", len(res.Cookies())), t)
+	if assertTrue(len(errs) == 1, fmt.Sprintf("expected 1 error, got %d", len(errs)), t) {
+		assertTrue(errs[0] == ErrSessionCookieTooLarge, fmt.Sprintf("expected error %s, got %v", ErrSessionCookieTooLarge, errs[0]), t)
+	}
+}
+
+func TestCookieStoreNoSecret(t *testing.T) {
+	cs, err := NewCookieStore(&CookieStoreOptions{
+		HashKey:  cookieHashKey,
+		BlockKey: cookieBlockKey,
+	})
+	if err != nil {
+		panic(err)
+	}
+	// The cookie is authenticated by the store, the secret is not required
+	s := setupTestOpts(func(w http.ResponseWriter, r *http.Request) {
+		ssn, _ := GetSession(w)
+		if v, ok := ssn.Get("foo").(string); ok {
+			w.Write([]byte(v))
+			return
+		}
+		ssn.Set("foo", "bar")
+		w.Write([]byte("new"))
+	}, NewSessionOptions(cs, ""))
+	defer s.Close()
+
+	res, body := doRequestWithCookie(s.URL, nil)
+	assertTrue(body == "new", fmt.Sprintf("expected body 'new', got '%s'", body), t)
+	cks := res.Cookies()
+	if assertTrue(len(cks) == 1, fmt.Sprintf("expected 1 cookie, got %d", len(cks)), t) {
+		_, body = doRequestWithCookie(s.URL, cks[0])
+		assertTrue(body == "bar", fmt.Sprintf("expected body 'bar', got '%s'", body), t)
+	}
+}
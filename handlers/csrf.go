@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+
+	"github.com/PuerkitoBio/ghost"
+)
+
+const (
+	defaultCSRFFieldName  = "csrf_token"
+	defaultCSRFHeaderName = "X-CSRF-Token"
+
+	// Session data key of the CSRF secret, and its length in bytes.
+	csrfSecretKey = "_csrf.secret"
+	csrfSecretLen = 32
+)
+
+var (
+	ErrCSRFTokenMissing = errors.New("csrf token is missing")
+	ErrCSRFTokenInvalid = errors.New("csrf token is invalid")
+)
+
+// Options for the CSRF handler.
+type CSRFOptions struct {
+	FieldName    string                                                  // Form field of the token, defaults to "csrf_token"
+	HeaderName   string                                                  // Header of the token, checked before the form field, defaults to "X-CSRF-Token"
+	ErrorHandler func(w http.ResponseWriter, r *http.Request, err error) // Called when the token is missing or invalid, defaults to a 403 Forbidden
+}
+
+// Internal writer that holds the CSRF secret of the session for the current request.
+type csrfResponseWriter struct {
+	http.ResponseWriter
+	secret []byte
+	opts   *CSRFOptions
+}
+
+// Implement the WrapWriter interface.
+func (this *csrfResponseWriter) WrappedWriter() http.ResponseWriter {
+	return this.ResponseWriter
+}
+
+// Get a new masked token for the secret.
+func (this *csrfResponseWriter) token() string {
+	return maskCSRFToken(this.secret)
+}
+
+// Get the hidden input field of a new masked token.
+func (this *csrfResponseWriter) field() template.HTML {
+	return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`,
+		template.HTMLEscapeString(this.opts.FieldName), this.token()))
+}
+
+// CSRFHandlerFunc is the same as CSRFHandler, it is just a convenience
+// signature that accepts a func(http.ResponseWriter, *http.Request) instead of
+// a http.Handler interface. It saves the boilerplate http.HandlerFunc() cast.
+func CSRFHandlerFunc(h http.HandlerFunc, opts *CSRFOptions) http.HandlerFunc {
+	return CSRFHandler(h, opts)
+}
+
+// Create a CSRF handler that protects the wrapped handler against cross-site request
+// forgery. It must be wrapped by a SessionHandler: a random secret is saved in the
+// session, and the requests with an unsafe method (other than GET, HEAD, OPTIONS and
+// TRACE) must send a token for this secret in the header or the form field. Tokens are
+// obtained via GetCSRFToken or CSRFTemplateField (or the GhostWriter), and are masked
+// with a random value each time, so that they cannot be guessed by compression attacks
+// (BREACH). The options may be nil to use the defaults.
+func CSRFHandler(h http.Handler, opts *CSRFOptions) http.HandlerFunc {
+	if opts == nil {
+		opts = new(CSRFOptions)
+	}
+	if opts.FieldName == "" {
+		opts.FieldName = defaultCSRFFieldName
+	}
+	if opts.HeaderName == "" {
+		opts.HeaderName = defaultCSRFHeaderName
+	}
+	if opts.ErrorHandler == nil {
+		opts.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		}
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := getCSRFWriter(w); ok {
+			// Self-awareness
+			h.ServeHTTP(w, r)
+			return
+		}
+		sess, ok := GetSession(w)
+		if !ok {
+			ghost.LogFn("ghost.csrf : no session, the CSRF handler must be wrapped by a session handler")
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		secret, err := getCSRFSecret(sess)
+		if err != nil {
+			ghost.LogFn("ghost.csrf : error generating secret : %s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS", "TRACE":
+			// Safe methods, no token required
+		default:
+			tok := r.Header.Get(opts.HeaderName)
+			if tok == "" {
+				tok = r.FormValue(opts.FieldName)
+			}
+			if tok == "" {
+				opts.ErrorHandler(w, r, ErrCSRFTokenMissing)
+				return
+			}
+			if !checkCSRFToken(tok, secret) {
+				opts.ErrorHandler(w, r, ErrCSRFTokenInvalid)
+				return
+			}
+		}
+		h.ServeHTTP(&csrfResponseWriter{w, secret, opts}, r)
+	}
+}
+
+// Get a new masked CSRF token for the session of the current request.
+func GetCSRFToken(w http.ResponseWriter) (string, bool) {
+	csrfw, ok := getCSRFWriter(w)
+	if ok {
+		return csrfw.token(), true
+	}
+	return "", false
+}
+
+// Get the hidden input field of a new masked CSRF token, to add to a form in a
+// template. It is empty if there is no CSRF handler.
+func CSRFTemplateField(w http.ResponseWriter) template.HTML {
+	csrfw, ok := getCSRFWriter(w)
+	if ok {
+		return csrfw.field()
+	}
+	return ""
+}
+
+// Check the writer chain to find a csrfResponseWriter.
+func getCSRFWriter(w http.ResponseWriter) (*csrfResponseWriter, bool) {
+	csrfw, ok := GetResponseWriter(w, func(tst http.ResponseWriter) bool {
+		_, ok := tst.(*csrfResponseWriter)
+		return ok
+	})
+	if ok {
+		return csrfw.(*csrfResponseWriter), true
+	}
+	return nil, false
+}
+
+// Get the CSRF secret of the session, it is generated if the session does not
+// have one yet.
+func getCSRFSecret(sess *Session) ([]byte, error) {
+	if s, ok := sess.Get(csrfSecretKey).(string); ok {
+		if b, err := base64.StdEncoding.DecodeString(s); err == nil && len(b) == csrfSecretLen {
+			return b, nil
+		}
+	}
+	b := make([]byte, csrfSecretLen)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	sess.Set(csrfSecretKey, base64.StdEncoding.EncodeToString(b))
+	return b, nil
+}
+
+// Mask the secret with a random pad, the token is the pad followed by the
+// secret XOR the pad.
+func maskCSRFToken(secret []byte) string {
+	tok := make([]byte, 2*len(secret))
+	if _, err := rand.Read(tok[:len(secret)]); err != nil {
+		panic(err)
+	}
+	for i, b := range secret {
+		tok[len(secret)+i] = b ^ tok[i]
+	}
+	return base64.RawURLEncoding.EncodeToString(tok)
+}
+
+// Check that the masked token is a token for the secret.
+func checkCSRFToken(tok string, secret []byte) bool {
+	b, err := base64.RawURLEncoding.DecodeString(tok)
+	if err != nil || len(b) != 2*len(secret) {
+		return false
+	}
+	pad, masked := b[:len(secret)], b[len(secret):]
+	for i := range masked {
+		masked[i] ^= pad[i]
+	}
+	return subtle.ConstantTimeCompare(masked, secret) == 1
+}
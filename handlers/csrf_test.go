@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func setupCSRFTest(t *testing.T, opts *CSRFOptions) *httptest.Server {
+	ms := NewMemoryStore(2)
+	t.Cleanup(func() { ms.Close() })
+	return httptest.NewServer(SessionHandler(CSRFHandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			tok, ok := GetCSRFToken(w)
+			if !ok {
+				panic("no CSRF token")
+			}
+			w.Write([]byte(tok))
+		}, opts), NewSessionOptions(ms, secret)))
+}
+
+func newCSRFClient() *http.Client {
+	jar, err := cookiejar.New(new(cookiejar.Options))
+	if err != nil {
+		panic(err)
+	}
+	return &http.Client{Jar: jar}
+}
+
+func doCSRFRequest(c *http.Client, req *http.Request) (*http.Response, string) {
+	res, err := c.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		panic(err)
+	}
+	return res, string(b)
+}
+
+func TestCSRF(t *testing.T) {
+	s, c := setupCSRFTest(t, nil), newCSRFClient()
+	defer s.Close()
+
+	req, _ := http.NewRequest("GET", s.URL, nil)
+	res, tok := doCSRFRequest(c, req)
+	assertStatus(http.StatusOK, res.StatusCode, t)
+	assertTrue(tok != "", "expected a CSRF token", t)
+
+	// No token
+	req, _ = http.NewRequest("POST", s.URL, nil)
+	res, _ = doCSRFRequest(c, req)
+	assertStatus(http.StatusForbidden, res.StatusCode, t)
+
+	// Invalid token
+	req, _ = http.NewRequest("POST", s.URL, nil)
+	req.Header.Set("X-CSRF-Token", "nope")
+	res, _ = doCSRFRequest(c, req)
+	assertStatus(http.StatusForbidden, res.StatusCode, t)
+
+	// Token in the header
+	req, _ = http.NewRequest("POST", s.URL, nil)
+	req.Header.Set("X-CSRF-Token", tok)
+	res, tok2 := doCSRFRequest(c, req)
+	assertStatus(http.StatusOK, res.StatusCode, t)
+	assertTrue(tok2 != tok, "expected a different masked token", t)
+
+	// Both tokens are still valid, in the form field
+	for _, tk := range []string{tok, tok2} {
+		req, _ = http.NewRequest("POST", s.URL, strings.NewReader(url.Values{"csrf_token": {tk}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res, _ = doCSRFRequest(c, req)
+		assertStatus(http.StatusOK, res.StatusCode, t)
+	}
+
+	// Token of another session
+	c2 := newCSRFClient()
+	req, _ = http.NewRequest("GET", s.URL, nil)
+	doCSRFRequest(c2, req)
+	req, _ = http.NewRequest("POST", s.URL, nil)
+	req.Header.Set("X-CSRF-Token", tok)
+	res, _ = doCSRFRequest(c2, req)
+	assertStatus(http.StatusForbidden, res.StatusCode, t)
+}
+
+func TestCSRFErrorHandler(t *testing.T) {
+	var got error
+	c := newCSRFClient()
+	s := setupCSRFTest(t, &CSRFOptions{
+		FieldName:  "tok",
+		HeaderName: "X-Tok",
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			got = err
+			w.WriteHeader(http.StatusTeapot)
+		},
+	})
+	defer s.Close()
+
+	req, _ := http.NewRequest("GET", s.URL, nil)
+	_, tok := doCSRFRequest(c, req)
+
+	req, _ = http.NewRequest("DELETE", s.URL, nil)
+	res, _ := doCSRFRequest(c, req)
+	assertStatus(http.StatusTeapot, res.StatusCode, t)
+	assertTrue(got == ErrCSRFTokenMissing, fmt.Sprintf("expected error %v, got %v", ErrCSRFTokenMissing, got), t)
+
+	req, _ = http.NewRequest("DELETE", s.URL, nil)
+	req.Header.Set("X-CSRF-Token", tok)
+	res, _ = doCSRFRequest(c, req)
+	assertStatus(http.StatusTeapot, res.StatusCode, t)
+
+	req, _ = http.NewRequest("DELETE", s.URL+"?tok="+url.QueryEscape(tok+"x"), nil)
+	res, _ = doCSRFRequest(c, req)
+	assertStatus(http.StatusTeapot, res.StatusCode, t)
+	assertTrue(got == ErrCSRFTokenInvalid, fmt.Sprintf("expected error %v, got %v", ErrCSRFTokenInvalid, got), t)
+
+	req, _ = http.NewRequest("DELETE", s.URL, nil)
+	req.Header.Set("X-Tok", tok)
+	res, _ = doCSRFRequest(c, req)
+	assertStatus(http.StatusOK, res.StatusCode, t)
+}
+
+func TestCSRFGhostWriter(t *testing.T) {
+	ms := NewMemoryStore(1)
+	defer ms.Close()
+	s := httptest.NewServer(SessionHandler(CSRFHandler(GhostHandlerFunc(
+		func(w GhostWriter, r *http.Request) {
+			f := string(w.CSRFField())
+			assertTrue(strings.HasPrefix(f, `<input type="hidden" name="csrf_token" value="`), fmt.Sprintf("unexpected field %s", f), t)
+			assertTrue(w.CSRFToken() != "", "expected a CSRF token", t)
+			assertTrue(CSRFTemplateField(w) != "", "expected a CSRF field", t)
+		}), nil), NewSessionOptions(ms, secret)))
+	defer s.Close()
+
+	res := doRequest(s.URL, true)
+	assertStatus(http.StatusOK, res.StatusCode, t)
+}
+
+func TestCSRFNoSession(t *testing.T) {
+	s := httptest.NewServer(CSRFHandlerFunc(func(w http.ResponseWriter, r *http.Request) {}, nil))
+	defer s.Close()
+
+	res := doRequest(s.URL, true)
+	assertStatus(http.StatusInternalServerError, res.StatusCode, t)
+}
@@ -0,0 +1,357 @@
+package handlers
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fileStoreExt               = ".sess"
+	defaultFileCleanupInterval = 10 * time.Minute
+
+	// Prefix of the temporary files, followed by their Unix creation time.
+	fileStoreTempPrefix = ".tmp-"
+	// Age after which a temporary file is left by a crash and can be removed.
+	fileStoreTempMaxAge = time.Hour
+)
+
+var (
+	ErrNoDir            = errors.New("file store directory is missing")
+	ErrInvalidSessionID = errors.New("invalid session ID")
+)
+
+type FileStoreOptions struct {
+	Dir                  string        // Required, directory of the session files, created if it does not exist
+	CleanupInterval      time.Duration // Interval between removals of expired session files, defaults to 10 minutes
+	BrowserSessServerTTL time.Duration // Defaults to 2 days
+	Codec                SessionCodec  // Encoding of the sessions, defaults to JSONCodec
+}
+
+// File system implementation of a session store, for single-server deployments
+// where sessions must survive a restart. Each session is saved in its own file,
+// and the modification time of the file is set to the expiration time of the
+// session. A single background goroutine removes the expired session files, it
+// is stopped by Close.
+type FileStore struct {
+	l    sync.RWMutex
+	opts *FileStoreOptions
+	stop chan struct{}
+	once sync.Once
+}
+
+// Create a file session store with the specified options.
+func NewFileStore(opts *FileStoreOptions) (*FileStore, error) {
+	if opts.Dir == "" {
+		return nil, ErrNoDir
+	}
+	if err := os.MkdirAll(opts.Dir, 0700); err != nil {
+		return nil, err
+	}
+	fs := &FileStore{
+		opts: opts,
+		stop: make(chan struct{}),
+	}
+	go fs.cleanup()
+	return fs, nil
+}
+
+// Get the session from the store.
+func (this *FileStore) Get(id string) (*Session, error) {
+	fn, err := this.getFileName(id)
+	if err != nil {
+		return nil, err
+	}
+	this.l.RLock()
+	defer this.l.RUnlock()
+	fi, err := os.Stat(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if time.Now().After(fi.ModTime()) {
+		// Expired, it will be removed by the cleanup
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	return getCodec(this.opts.Codec).Decode(b)
+}
+
+// Save the session into the store. The file is written to a temporary file
+// and then renamed, so that it is never partially written.
+func (this *FileStore) Set(sess *Session) error {
+	fn, err := this.getFileName(sess.ID())
+	if err != nil {
+		return err
+	}
+	tmp, err := this.writeTemp(sess)
+	if err != nil {
+		return err
+	}
+
+	this.l.Lock()
+	defer this.l.Unlock()
+	if err = os.Rename(tmp, fn); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Save the session into the store if id is in the store, and delete id if it is
+// not the ID of the session.
+func (this *FileStore) Replace(sess *Session, id string) (bool, error) {
+	oldFn, err := this.getFileName(id)
+	if err != nil {
+		return false, err
+	}
+	fn, err := this.getFileName(sess.ID())
+	if err != nil {
+		return false, err
+	}
+	tmp, err := this.writeTemp(sess)
+	if err != nil {
+		return false, err
+	}
+
+	this.l.Lock()
+	defer this.l.Unlock()
+	fi, err := os.Stat(oldFn)
+	if err != nil || time.Now().After(fi.ModTime()) {
+		os.Remove(tmp)
+		if err == nil || os.IsNotExist(err) {
+			// Missing or expired
+			return false, nil
+		}
+		return false, err
+	}
+	if err = os.Rename(tmp, fn); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	if oldFn != fn {
+		if err = os.Remove(oldFn); err != nil && !os.IsNotExist(err) {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// Write the encoded session to a new temporary file of the store directory, with
+// the expiration time of the session, and return the name of the file. The creation
+// time is in the name of the file, since its modification time is the expiration.
+func (this *FileStore) writeTemp(sess *Session) (string, error) {
+	b, err := getCodec(this.opts.Codec).Encode(sess)
+	if err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(this.opts.Dir, fileStoreTempPrefix+strconv.FormatInt(time.Now().Unix(), 10)+"-")
+	if err != nil {
+		return "", err
+	}
+	tmp := f.Name()
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		exp := time.Now().Add(sessionTTL(sess, this.opts.BrowserSessServerTTL))
+		err = os.Chtimes(tmp, exp, exp)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
+
+// Reset the expiration and save the last access time of the session, without
+// saving its content. The stored session is read and written again under the lock
+// of the store, a missing or expired session is not created again.
+func (this *FileStore) Touch(sess *Session) error {
+	fn, err := this.getFileName(sess.ID())
+	if err != nil {
+		return err
+	}
+	this.l.Lock()
+	defer this.l.Unlock()
+	fi, err := os.Stat(fn)
+	if err != nil || time.Now().After(fi.ModTime()) {
+		if err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	stored, err := getCodec(this.opts.Codec).Decode(b)
+	if err != nil {
+		return err
+	}
+	stored.internalSession.LastAccess = sess.internalSession.LastAccess
+	stored.internalSession.MaxAge = sess.internalSession.MaxAge
+	tmp, err := this.writeTemp(stored)
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, fn); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Delete the session from the store.
+func (this *FileStore) Delete(id string) error {
+	fn, err := this.getFileName(id)
+	if err != nil {
+		return err
+	}
+	this.l.Lock()
+	defer this.l.Unlock()
+	err = os.Remove(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Clear all sessions from the store.
+func (this *FileStore) Clear() error {
+	this.l.Lock()
+	defer this.l.Unlock()
+	fis, err := this.readDir()
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		err = os.Remove(filepath.Join(this.opts.Dir, fi.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the number of sessions in the store, not counting the expired sessions.
+// Returns -1 if the directory cannot be read.
+func (this *FileStore) Len() int {
+	this.l.RLock()
+	defer this.l.RUnlock()
+	fis, err := this.readDir()
+	if err != nil {
+		return -1
+	}
+	n := 0
+	now := time.Now()
+	for _, fi := range fis {
+		if !now.After(fi.ModTime()) {
+			n++
+		}
+	}
+	return n
+}
+
+// Stop the background goroutine that removes the expired session files.
+func (this *FileStore) Close() error {
+	this.once.Do(func() {
+		close(this.stop)
+	})
+	return nil
+}
+
+// Remove the expired session files at each cleanup interval, until the store is closed.
+func (this *FileStore) cleanup() {
+	iv := this.opts.CleanupInterval
+	if iv <= 0 {
+		iv = defaultFileCleanupInterval
+	}
+	t := time.NewTicker(iv)
+	defer t.Stop()
+	for {
+		select {
+		case <-this.stop:
+			return
+		case now := <-t.C:
+			this.removeExpired(now)
+		}
+	}
+}
+
+// Remove the session files that are expired at the specified time, and the
+// temporary files left by a crash before they were renamed.
+func (this *FileStore) removeExpired(now time.Time) {
+	this.l.Lock()
+	defer this.l.Unlock()
+	fis, err := this.readDir()
+	if err != nil {
+		return
+	}
+	for _, fi := range fis {
+		if now.After(fi.ModTime()) {
+			os.Remove(filepath.Join(this.opts.Dir, fi.Name()))
+		}
+	}
+	this.removeStaleTemps(now)
+}
+
+// Remove the temporary files created more than fileStoreTempMaxAge before the
+// specified time. The files being written are more recent.
+func (this *FileStore) removeStaleTemps(now time.Time) {
+	fis, err := ioutil.ReadDir(this.opts.Dir)
+	if err != nil {
+		return
+	}
+	for _, fi := range fis {
+		nm := fi.Name()
+		if !fi.Mode().IsRegular() || !strings.HasPrefix(nm, fileStoreTempPrefix) {
+			continue
+		}
+		created := strings.TrimPrefix(nm, fileStoreTempPrefix)
+		if i := strings.Index(created, "-"); i >= 0 {
+			created = created[:i]
+		}
+		secs, err := strconv.ParseInt(created, 10, 64)
+		if err != nil || now.Sub(time.Unix(secs, 0)) > fileStoreTempMaxAge {
+			// Unknown creation time or stale
+			os.Remove(filepath.Join(this.opts.Dir, nm))
+		}
+	}
+}
+
+// Get the session files of the store directory.
+func (this *FileStore) readDir() ([]os.FileInfo, error) {
+	fis, err := ioutil.ReadDir(this.opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	res := fis[:0]
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && strings.HasSuffix(fi.Name(), fileStoreExt) {
+			res = append(res, fi)
+		}
+	}
+	return res, nil
+}
+
+// Get the path of the file of the session ID. The ID must not contain path separators.
+func (this *FileStore) getFileName(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return "", ErrInvalidSessionID
+	}
+	return filepath.Join(this.opts.Dir, id+fileStoreExt), nil
+}
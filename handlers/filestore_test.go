@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestFileStore(iv time.Duration) (*FileStore, string) {
+	dir, err := ioutil.TempDir("", "ghost-filestore")
+	if err != nil {
+		panic(err)
+	}
+	fs, err := NewFileStore(&FileStoreOptions{
+		Dir:             dir,
+		CleanupInterval: iv,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return fs, dir
+}
+
+func TestFileStoreSession(t *testing.T) {
+	fs, dir := newTestFileStore(0)
+	defer os.RemoveAll(dir)
+	defer fs.Close()
+
+	store = fs
+	t.Log("SessionExists")
+	testSessionExists(t)
+	t.Log("SessionPersists")
+	testSessionPersists(t)
+	t.Log("SessionExpires")
+	testSessionExpires(t)
+	t.Log("SessionBeforeExpires")
+	testSessionBeforeExpires(t)
+	t.Log("SessionSlidingExpiration")
+	testSessionSlidingExpiration(t)
+	t.Log("SessionRegenerate")
+	testSessionRegenerate(t)
+	t.Log("SessionDestroy")
+	testSessionDestroy(t)
+}
+
+func TestFileStoreClearLen(t *testing.T) {
+	fs, dir := newTestFileStore(0)
+	defer os.RemoveAll(dir)
+	defer fs.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := fs.Set(newSession(0)); err != nil {
+			panic(err)
+		}
+	}
+	// Other files in the directory are not sessions
+	if err := ioutil.WriteFile(filepath.Join(dir, "other.txt"), []byte("x"), 0600); err != nil {
+		panic(err)
+	}
+	assertTrue(fs.Len() == 3, fmt.Sprintf("expected store to have 3 sessions, got %d", fs.Len()), t)
+	if err := fs.Clear(); err != nil {
+		panic(err)
+	}
+	assertTrue(fs.Len() == 0, fmt.Sprintf("expected store to have 0 session, got %d", fs.Len()), t)
+	_, err := os.Stat(filepath.Join(dir, "other.txt"))
+	assertTrue(err == nil, "expected other file to be kept", t)
+}
+
+func TestFileStoreCleanup(t *testing.T) {
+	fs, dir := newTestFileStore(10 * time.Millisecond)
+	defer os.RemoveAll(dir)
+	defer fs.Close()
+
+	ssn := newSession(0)
+	ssn.internalSession.MaxAge = 20 * time.Millisecond
+	fs.Set(ssn)
+	fs.Set(newSession(0))
+	time.Sleep(50 * time.Millisecond)
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		panic(err)
+	}
+	assertTrue(len(fis) == 1, fmt.Sprintf("expected expired session file to be removed, got %d files", len(fis)), t)
+}
+
+func TestFileStoreInvalidID(t *testing.T) {
+	fs, dir := newTestFileStore(0)
+	defer os.RemoveAll(dir)
+	defer fs.Close()
+
+	for _, id := range []string{"", "../foo", `a\b`, ".hidden"} {
+		_, err := fs.Get(id)
+		assertTrue(err == ErrInvalidSessionID, fmt.Sprintf("expected error %s for ID %q, got %v", ErrInvalidSessionID, id, err), t)
+	}
+}
+
+func TestFileStoreStaleTemps(t *testing.T) {
+	fs, dir := newTestFileStore(0)
+	defer os.RemoveAll(dir)
+	defer fs.Close()
+
+	// Temporary files left by a crash before the rename
+	now := time.Now()
+	stale := filepath.Join(dir, fmt.Sprintf("%s%d-1", fileStoreTempPrefix, now.Add(-2*fileStoreTempMaxAge).Unix()))
+	recent := filepath.Join(dir, fmt.Sprintf("%s%d-2", fileStoreTempPrefix, now.Unix()))
+	for _, fn := range []string{stale, recent} {
+		if err := ioutil.WriteFile(fn, []byte("x"), 0600); err != nil {
+			panic(err)
+		}
+	}
+	fs.removeExpired(now)
+	_, err := os.Stat(stale)
+	assertTrue(os.IsNotExist(err), "expected stale temporary file to be removed", t)
+	_, err = os.Stat(recent)
+	assertTrue(err == nil, "expected recent temporary file to be kept", t)
+}
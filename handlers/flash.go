@@ -0,0 +1,40 @@
+package handlers
+
+// Prefix of the session data keys that hold the flash messages, followed by the kind.
+const flashKeyPrefix = "_flash."
+
+// Add a flash message of the specified kind (i.e. "error", "info", etc.) to the
+// session. It is kept in the session until it is read via Flashes.
+func (ø *Session) AddFlash(kind, msg string) {
+	key := flashKeyPrefix + kind
+	ø.Set(key, append(getFlashes(ø.Get(key)), msg))
+}
+
+// Get the flash messages of the specified kind, and remove them from the session.
+func (ø *Session) Flashes(kind string) []string {
+	key := flashKeyPrefix + kind
+	v, ok := ø.Data[key]
+	if !ok {
+		return nil
+	}
+	ø.Delete(key)
+	return getFlashes(v)
+}
+
+// Convert the flash messages stored in the session data. Once the session has
+// been marshaled to JSON and back, the slice of strings is a slice of empty interfaces.
+func getFlashes(v interface{}) []string {
+	switch msgs := v.(type) {
+	case []string:
+		return msgs
+	case []interface{}:
+		res := make([]string, 0, len(msgs))
+		for _, m := range msgs {
+			if s, ok := m.(string); ok {
+				res = append(res, s)
+			}
+		}
+		return res
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestFlashes(t *testing.T) {
+	ssn := newSession(0)
+	ssn.AddFlash("error", "a")
+	ssn.AddFlash("error", "b")
+	ssn.AddFlash("info", "c")
+
+	f := ssn.Flashes("error")
+	assertTrue(reflect.DeepEqual(f, []string{"a", "b"}), fmt.Sprintf("expected error flashes to be [a b], got %v", f), t)
+	f = ssn.Flashes("error")
+	assertTrue(len(f) == 0, fmt.Sprintf("expected error flashes to be removed, got %v", f), t)
+	f = ssn.Flashes("info")
+	assertTrue(reflect.DeepEqual(f, []string{"c"}), fmt.Sprintf("expected info flashes to be [c], got %v", f), t)
+	assertTrue(len(ssn.Data) == 0, fmt.Sprintf("expected session data to be empty, got %d", len(ssn.Data)), t)
+}
+
+func TestFlashesJSON(t *testing.T) {
+	ssn := newSession(0)
+	ssn.AddFlash("info", "a")
+	b, err := json.Marshal(ssn)
+	if err != nil {
+		panic(err)
+	}
+	var ssn2 Session
+	if err := json.Unmarshal(b, &ssn2); err != nil {
+		panic(err)
+	}
+	ssn2.AddFlash("info", "b")
+	f := ssn2.Flashes("info")
+	assertTrue(reflect.DeepEqual(f, []string{"a", "b"}), fmt.Sprintf("expected info flashes to be [a b], got %v", f), t)
+}
+
+func TestGhostWriterFlashes(t *testing.T) {
+	cnt := 0
+	ms := NewMemoryStore(1)
+	defer ms.Close()
+	s := httptest.NewServer(SessionHandler(GhostHandlerFunc(
+		func(w GhostWriter, r *http.Request) {
+			if cnt == 0 {
+				w.AddFlash("info", "saved")
+			} else {
+				for _, f := range w.Flashes("info") {
+					w.Write([]byte(f))
+				}
+			}
+			cnt++
+			w.Write([]byte("ok"))
+		}), NewSessionOptions(ms, secret)))
+	defer s.Close()
+
+	res := doRequest(s.URL, true)
+	assertStatus(http.StatusOK, res.StatusCode, t)
+	assertBody([]byte("ok"), res, t)
+	res = doRequest(s.URL, false)
+	assertStatus(http.StatusOK, res.StatusCode, t)
+	assertBody([]byte("savedok"), res, t)
+	res = doRequest(s.URL, false)
+	assertStatus(http.StatusOK, res.StatusCode, t)
+	assertBody([]byte("ok"), res, t)
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"html/template"
 	"net/http"
 )
 
@@ -11,6 +12,10 @@ type GhostWriter interface {
 	User() interface{}
 	Context() map[interface{}]interface{}
 	Session() *Session
+	AddFlash(kind, msg string)
+	Flashes(kind string) []string
+	CSRFToken() string
+	CSRFField() template.HTML
 }
 
 // Internal implementation of the GhostWriter interface.
@@ -20,6 +25,12 @@ type ghostWriter struct {
 	user     interface{}
 	ctx      map[interface{}]interface{}
 	ssn      *Session
+	csrf     *csrfResponseWriter
+}
+
+// Implement the WrapWriter interface.
+func (this *ghostWriter) WrappedWriter() http.ResponseWriter {
+	return this.ResponseWriter
 }
 
 func (this *ghostWriter) UserName() string {
@@ -38,6 +49,40 @@ func (this *ghostWriter) Session() *Session {
 	return this.ssn
 }
 
+// Add a flash message to the session, if there is a session.
+func (this *ghostWriter) AddFlash(kind, msg string) {
+	if this.ssn != nil {
+		this.ssn.AddFlash(kind, msg)
+	}
+}
+
+// Get and remove the flash messages from the session, if there is a session.
+// Because it is a method on the writer, it can be called from a template that
+// receives the writer in its data (i.e. {{range .Flashes "error"}}).
+func (this *ghostWriter) Flashes(kind string) []string {
+	if this.ssn != nil {
+		return this.ssn.Flashes(kind)
+	}
+	return nil
+}
+
+// Get a new masked CSRF token, if there is a CSRF handler.
+func (this *ghostWriter) CSRFToken() string {
+	if this.csrf != nil {
+		return this.csrf.token()
+	}
+	return ""
+}
+
+// Get the hidden input field of a new masked CSRF token, if there is a CSRF
+// handler. It can be called from a template (i.e. {{.CSRFField}}).
+func (this *ghostWriter) CSRFField() template.HTML {
+	if this.csrf != nil {
+		return this.csrf.field()
+	}
+	return ""
+}
+
 // Convenience handler that wraps a custom function with direct access to the
 // authenticated user, context and session on the writer.
 func GhostHandlerFunc(h func(w GhostWriter, r *http.Request)) http.HandlerFunc {
@@ -51,12 +96,14 @@ func GhostHandlerFunc(h func(w GhostWriter, r *http.Request)) http.HandlerFunc {
 		usr, _ := GetUser(w)
 		ctx, _ := GetContext(w)
 		ssn, _ := GetSession(w)
+		csrf, _ := getCSRFWriter(w)
 		gw := &ghostWriter{
 			w,
 			uid,
 			usr,
 			ctx,
 			ssn,
+			csrf,
 		}
 		h(gw, r)
 	}
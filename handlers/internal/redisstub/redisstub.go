@@ -0,0 +1,800 @@
+// Package redisstub implements an in-process stub of a Redis server, that speaks
+// the RESP protocol and supports the subset of the commands used by the RedisStore
+// (strings, sets, sorted sets, expiration, transactions and SCAN), so that it can be
+// tested without a Redis server.
+package redisstub
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const numDatabases = 16
+
+var (
+	errSyntax    = errors.New("ERR syntax error")
+	errNotInt    = errors.New("ERR value is not an integer or out of range")
+	errNotFloat  = errors.New("ERR value is not a valid float")
+	errWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	errBadExpire = errors.New("ERR invalid expire time")
+	errDB        = errors.New("ERR DB index is out of range")
+)
+
+// The value of a key, one of a string, a set or a sorted set.
+type value struct {
+	str  []byte
+	set  map[string]struct{}
+	zset map[string]float64
+	exp  time.Time // Zero if the key does not expire
+}
+
+// Server is a stub Redis server listening on a local TCP address.
+type Server struct {
+	l     sync.Mutex
+	ln    net.Listener
+	dbs   [numDatabases]map[string]*value
+	vers  map[string]int64 // Modification counter of the keys, for WATCH
+	delay time.Duration
+	scans map[int][]string // Remaining keys of the SCAN iterations, by cursor
+	next  int              // Last SCAN cursor returned
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// NewServer starts a stub server on a random local port.
+func NewServer() (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		ln:    ln,
+		vers:  make(map[string]int64),
+		scans: make(map[int][]string),
+		conns: make(map[net.Conn]struct{}),
+	}
+	for i := range s.dbs {
+		s.dbs[i] = make(map[string]*value)
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the address of the server.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// SetDelay sets a delay before each reply of the server, to simulate a slow server.
+func (s *Server) SetDelay(d time.Duration) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.delay = d
+}
+
+// Keys returns the sorted keys of the database that are not expired.
+func (s *Server) Keys(db int) []string {
+	s.l.Lock()
+	defer s.l.Unlock()
+	var keys []string
+	for k := range s.dbs[db] {
+		if s.lookup(db, k) != nil {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// DropConns closes all client connections, to simulate connections dropped by the
+// server. The server keeps accepting new connections.
+func (s *Server) DropConns() {
+	s.l.Lock()
+	defer s.l.Unlock()
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+// Close stops the server and closes all client connections.
+func (s *Server) Close() error {
+	err := s.ln.Close()
+	s.l.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.l.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// Accept the connections until the listener is closed.
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.l.Lock()
+		s.conns[c] = struct{}{}
+		s.l.Unlock()
+		s.wg.Add(1)
+		go s.handle(c)
+	}
+}
+
+// The state of a client connection.
+type client struct {
+	db      int
+	multi   bool
+	queued  [][]string
+	watched map[string]int64 // The modification counter of the watched keys
+}
+
+// Read the commands of the connection and write the replies, until the connection
+// is closed.
+func (s *Server) handle(c net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.l.Lock()
+		delete(s.conns, c)
+		s.l.Unlock()
+		c.Close()
+	}()
+	br, bw := bufio.NewReader(c), bufio.NewWriter(c)
+	cl := &client{}
+	for {
+		args, err := readCommand(br)
+		if err != nil {
+			return
+		}
+		s.l.Lock()
+		delay := s.delay
+		s.l.Unlock()
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+		writeReply(bw, s.exec(cl, args))
+		// Flush only when the pipelined commands are all processed
+		if br.Buffered() == 0 {
+			if err := bw.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Read a command, an array of bulk strings.
+func readCommand(br *bufio.Reader) ([]string, error) {
+	line, err := readLine(br)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return nil, errSyntax
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err = readLine(br)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errSyntax
+		}
+		sz, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, sz+2)
+		if _, err = io.ReadFull(br, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:sz])
+	}
+	return args, nil
+}
+
+// Read a line, without the terminating CRLF.
+func readLine(br *bufio.Reader) (string, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// The types of the replies that are not mapped directly from Go types.
+type (
+	status    string
+	nilBulk   struct{}
+	nilArray  struct{}
+	replyList []interface{}
+)
+
+// Write the reply in the RESP format.
+func writeReply(bw *bufio.Writer, r interface{}) {
+	switch v := r.(type) {
+	case status:
+		fmt.Fprintf(bw, "+%s\r\n", v)
+	case error:
+		fmt.Fprintf(bw, "-%s\r\n", v)
+	case int:
+		fmt.Fprintf(bw, ":%d\r\n", v)
+	case []byte:
+		fmt.Fprintf(bw, "$%d\r\n%s\r\n", len(v), v)
+	case string:
+		fmt.Fprintf(bw, "$%d\r\n%s\r\n", len(v), v)
+	case nilBulk:
+		bw.WriteString("$-1\r\n")
+	case nilArray:
+		bw.WriteString("*-1\r\n")
+	case replyList:
+		fmt.Fprintf(bw, "*%d\r\n", len(v))
+		for _, e := range v {
+			writeReply(bw, e)
+		}
+	case []string:
+		fmt.Fprintf(bw, "*%d\r\n", len(v))
+		for _, e := range v {
+			writeReply(bw, e)
+		}
+	default:
+		panic(fmt.Sprintf("redisstub: unexpected reply type %T", r))
+	}
+}
+
+// Execute the command for the client, and return its reply. The commands are
+// queued during a transaction.
+func (s *Server) exec(cl *client, args []string) interface{} {
+	if len(args) == 0 {
+		return errSyntax
+	}
+	cmd := strings.ToUpper(args[0])
+	switch cmd {
+	case "MULTI":
+		if cl.multi {
+			return errors.New("ERR MULTI calls can not be nested")
+		}
+		cl.multi = true
+		return status("OK")
+	case "DISCARD":
+		if !cl.multi {
+			return errors.New("ERR DISCARD without MULTI")
+		}
+		cl.multi, cl.queued, cl.watched = false, nil, nil
+		return status("OK")
+	case "EXEC":
+		if !cl.multi {
+			return errors.New("ERR EXEC without MULTI")
+		}
+		return s.execMulti(cl)
+	case "WATCH":
+		if cl.multi {
+			return errors.New("ERR WATCH inside MULTI is not allowed")
+		}
+		s.l.Lock()
+		defer s.l.Unlock()
+		if cl.watched == nil {
+			cl.watched = make(map[string]int64)
+		}
+		for _, k := range args[1:] {
+			key := s.versionKey(cl.db, k)
+			s.lookup(cl.db, k) // Expire the key if needed, so it counts as a change
+			cl.watched[key] = s.vers[key]
+		}
+		return status("OK")
+	case "UNWATCH":
+		cl.watched = nil
+		return status("OK")
+	}
+	if cl.multi {
+		cl.queued = append(cl.queued, args)
+		return status("QUEUED")
+	}
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.run(cl, cmd, args[1:])
+}
+
+// Execute the queued commands of the transaction, unless a watched key was modified.
+func (s *Server) execMulti(cl *client) interface{} {
+	queued, watched := cl.queued, cl.watched
+	cl.multi, cl.queued, cl.watched = false, nil, nil
+
+	s.l.Lock()
+	defer s.l.Unlock()
+	for key, v := range watched {
+		db, k := splitVersionKey(key)
+		s.lookup(db, k)
+		if s.vers[key] != v {
+			return nilArray{}
+		}
+	}
+	res := make(replyList, 0, len(queued))
+	for _, args := range queued {
+		res = append(res, s.run(cl, strings.ToUpper(args[0]), args[1:]))
+	}
+	return res
+}
+
+// Run the command, the lock must be held by the caller.
+func (s *Server) run(cl *client, cmd string, args []string) interface{} {
+	switch cmd {
+	case "PING":
+		if len(args) > 0 {
+			return args[0]
+		}
+		return status("PONG")
+	case "ECHO":
+		if len(args) != 1 {
+			return errArgs(cmd)
+		}
+		return args[0]
+	case "SELECT":
+		if len(args) != 1 {
+			return errArgs(cmd)
+		}
+		db, err := strconv.Atoi(args[0])
+		if err != nil {
+			return errNotInt
+		}
+		if db < 0 || db >= numDatabases {
+			return errDB
+		}
+		cl.db = db
+		return status("OK")
+	case "GET":
+		if len(args) != 1 {
+			return errArgs(cmd)
+		}
+		v := s.lookup(cl.db, args[0])
+		if v == nil {
+			return nilBulk{}
+		}
+		if v.str == nil {
+			return errWrongType
+		}
+		return v.str
+	case "SET":
+		if len(args) != 2 {
+			return errArgs(cmd)
+		}
+		s.put(cl.db, args[0], &value{str: []byte(args[1])})
+		return status("OK")
+	case "SETEX":
+		if len(args) != 3 {
+			return errArgs(cmd)
+		}
+		secs, err := strconv.Atoi(args[1])
+		if err != nil {
+			return errNotInt
+		}
+		if secs <= 0 {
+			return errBadExpire
+		}
+		s.put(cl.db, args[0], &value{str: []byte(args[2]), exp: expiration(secs)})
+		return status("OK")
+	case "EXPIRE":
+		if len(args) != 2 {
+			return errArgs(cmd)
+		}
+		secs, err := strconv.Atoi(args[1])
+		if err != nil {
+			return errNotInt
+		}
+		v := s.lookup(cl.db, args[0])
+		if v == nil {
+			return 0
+		}
+		s.touch(cl.db, args[0])
+		if secs <= 0 {
+			delete(s.dbs[cl.db], args[0])
+			return 1
+		}
+		v.exp = expiration(secs)
+		return 1
+	case "TTL":
+		if len(args) != 1 {
+			return errArgs(cmd)
+		}
+		v := s.lookup(cl.db, args[0])
+		if v == nil {
+			return -2
+		}
+		if v.exp.IsZero() {
+			return -1
+		}
+		return int((v.exp.Sub(time.Now()) + time.Second/2) / time.Second)
+	case "DEL":
+		if len(args) == 0 {
+			return errArgs(cmd)
+		}
+		n := 0
+		for _, k := range args {
+			if s.lookup(cl.db, k) != nil {
+				delete(s.dbs[cl.db], k)
+				s.touch(cl.db, k)
+				n++
+			}
+		}
+		return n
+	case "EXISTS":
+		if len(args) == 0 {
+			return errArgs(cmd)
+		}
+		n := 0
+		for _, k := range args {
+			if s.lookup(cl.db, k) != nil {
+				n++
+			}
+		}
+		return n
+	case "SADD", "SREM":
+		if len(args) < 2 {
+			return errArgs(cmd)
+		}
+		v, err := s.lookupType(cl.db, args[0], cmd == "SADD", func(v *value) bool { return v.set != nil },
+			func() *value { return &value{set: make(map[string]struct{})} })
+		if err != nil || v == nil {
+			return errOrZero(err)
+		}
+		n := 0
+		for _, m := range args[1:] {
+			_, ok := v.set[m]
+			if cmd == "SADD" && !ok {
+				v.set[m] = struct{}{}
+				n++
+			} else if cmd == "SREM" && ok {
+				delete(v.set, m)
+				n++
+			}
+		}
+		s.modified(cl.db, args[0], v, n)
+		return n
+	case "SMEMBERS":
+		if len(args) != 1 {
+			return errArgs(cmd)
+		}
+		v, err := s.lookupType(cl.db, args[0], false, func(v *value) bool { return v.set != nil }, nil)
+		if err != nil {
+			return err
+		}
+		var res []string
+		if v != nil {
+			for m := range v.set {
+				res = append(res, m)
+			}
+			sort.Strings(res)
+		}
+		return res
+	case "SISMEMBER":
+		if len(args) != 2 {
+			return errArgs(cmd)
+		}
+		v, err := s.lookupType(cl.db, args[0], false, func(v *value) bool { return v.set != nil }, nil)
+		if err != nil || v == nil {
+			return errOrZero(err)
+		}
+		if _, ok := v.set[args[1]]; ok {
+			return 1
+		}
+		return 0
+	case "ZADD":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return errArgs(cmd)
+		}
+		v, err := s.lookupType(cl.db, args[0], true, func(v *value) bool { return v.zset != nil },
+			func() *value { return &value{zset: make(map[string]float64)} })
+		if err != nil {
+			return err
+		}
+		n := 0
+		for i := 1; i < len(args); i += 2 {
+			score, err := parseScore(args[i])
+			if err != nil {
+				return err
+			}
+			if _, ok := v.zset[args[i+1]]; !ok {
+				n++
+			}
+			v.zset[args[i+1]] = score
+		}
+		s.touch(cl.db, args[0])
+		return n
+	case "ZREM":
+		if len(args) < 2 {
+			return errArgs(cmd)
+		}
+		v, err := s.lookupType(cl.db, args[0], true, func(v *value) bool { return v.zset != nil }, nil)
+		if err != nil || v == nil {
+			return errOrZero(err)
+		}
+		n := 0
+		for _, m := range args[1:] {
+			if _, ok := v.zset[m]; ok {
+				delete(v.zset, m)
+				n++
+			}
+		}
+		s.modified(cl.db, args[0], v, n)
+		return n
+	case "ZCARD":
+		if len(args) != 1 {
+			return errArgs(cmd)
+		}
+		v, err := s.lookupType(cl.db, args[0], false, func(v *value) bool { return v.zset != nil }, nil)
+		if err != nil || v == nil {
+			return errOrZero(err)
+		}
+		return len(v.zset)
+	case "ZCOUNT":
+		if len(args) != 3 {
+			return errArgs(cmd)
+		}
+		min, err := parseScore(args[1])
+		if err != nil {
+			return err
+		}
+		max, err := parseScore(args[2])
+		if err != nil {
+			return err
+		}
+		v, err := s.lookupType(cl.db, args[0], false, func(v *value) bool { return v.zset != nil }, nil)
+		if err != nil || v == nil {
+			return errOrZero(err)
+		}
+		n := 0
+		for _, score := range v.zset {
+			if score >= min && score <= max {
+				n++
+			}
+		}
+		return n
+	case "ZRANGE":
+		if len(args) != 3 && len(args) != 4 {
+			return errArgs(cmd)
+		}
+		withScores := len(args) == 4
+		if withScores && strings.ToUpper(args[3]) != "WITHSCORES" {
+			return errSyntax
+		}
+		start, err := strconv.Atoi(args[1])
+		if err != nil {
+			return errNotInt
+		}
+		stop, err := strconv.Atoi(args[2])
+		if err != nil {
+			return errNotInt
+		}
+		v, err := s.lookupType(cl.db, args[0], false, func(v *value) bool { return v.zset != nil }, nil)
+		if err != nil {
+			return err
+		}
+		res := []string{}
+		if v == nil {
+			return res
+		}
+		// Sort the members by score, then lexicographically
+		members := make([]string, 0, len(v.zset))
+		for m := range v.zset {
+			members = append(members, m)
+		}
+		sort.Slice(members, func(i, j int) bool {
+			if v.zset[members[i]] != v.zset[members[j]] {
+				return v.zset[members[i]] < v.zset[members[j]]
+			}
+			return members[i] < members[j]
+		})
+		if start < 0 {
+			start += len(members)
+		}
+		if stop < 0 {
+			stop += len(members)
+		}
+		if start < 0 {
+			start = 0
+		}
+		for i := start; i <= stop && i < len(members); i++ {
+			res = append(res, members[i])
+			if withScores {
+				res = append(res, strconv.FormatFloat(v.zset[members[i]], 'f', -1, 64))
+			}
+		}
+		return res
+	case "ZREMRANGEBYSCORE":
+		if len(args) != 3 {
+			return errArgs(cmd)
+		}
+		min, err := parseScore(args[1])
+		if err != nil {
+			return err
+		}
+		max, err := parseScore(args[2])
+		if err != nil {
+			return err
+		}
+		v, err := s.lookupType(cl.db, args[0], true, func(v *value) bool { return v.zset != nil }, nil)
+		if err != nil || v == nil {
+			return errOrZero(err)
+		}
+		n := 0
+		for m, score := range v.zset {
+			if score >= min && score <= max {
+				delete(v.zset, m)
+				n++
+			}
+		}
+		s.modified(cl.db, args[0], v, n)
+		return n
+	case "SCAN":
+		return s.scan(cl.db, args)
+	}
+	return fmt.Errorf("ERR unknown command '%s'", cmd)
+}
+
+// Iterate over the keys. A new iteration takes a snapshot of the sorted keys, and
+// the cursor identifies the rest of that snapshot, so that keys deleted between
+// calls do not cause other keys to be skipped.
+func (s *Server) scan(db int, args []string) interface{} {
+	if len(args) == 0 || len(args)%2 != 1 {
+		return errArgs("SCAN")
+	}
+	cursor, err := strconv.Atoi(args[0])
+	if err != nil || cursor < 0 {
+		return errors.New("ERR invalid cursor")
+	}
+	match, count := "*", 10
+	for i := 1; i < len(args); i += 2 {
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			match = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count <= 0 {
+				return errSyntax
+			}
+		default:
+			return errSyntax
+		}
+	}
+	var keys []string
+	if cursor == 0 {
+		for k := range s.dbs[db] {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+	} else {
+		var ok bool
+		if keys, ok = s.scans[cursor]; !ok {
+			return errors.New("ERR invalid cursor")
+		}
+		delete(s.scans, cursor)
+	}
+	var res []string
+	i := 0
+	for ; i < len(keys) && i < count; i++ {
+		if ok, _ := path.Match(match, keys[i]); ok && s.lookup(db, keys[i]) != nil {
+			res = append(res, keys[i])
+		}
+	}
+	next := 0
+	if i < len(keys) {
+		s.next++
+		next = s.next
+		s.scans[next] = keys[i:]
+	}
+	return replyList{strconv.Itoa(next), res}
+}
+
+// Get the value of the key, or nil if it does not exist. An expired key is deleted.
+func (s *Server) lookup(db int, k string) *value {
+	v, ok := s.dbs[db][k]
+	if !ok {
+		return nil
+	}
+	if !v.exp.IsZero() && !time.Now().Before(v.exp) {
+		delete(s.dbs[db], k)
+		s.touch(db, k)
+		return nil
+	}
+	return v
+}
+
+// Get the value of the key and check its type. If it does not exist and create is
+// true, it is created with newFn. The caller must call touch if it modifies the value.
+func (s *Server) lookupType(db int, k string, create bool, isType func(*value) bool, newFn func() *value) (*value, error) {
+	v := s.lookup(db, k)
+	if v == nil {
+		if !create || newFn == nil {
+			return nil, nil
+		}
+		v = newFn()
+		s.dbs[db][k] = v
+	} else if !isType(v) {
+		return nil, errWrongType
+	}
+	return v, nil
+}
+
+// Set the value of the key.
+func (s *Server) put(db int, k string, v *value) {
+	s.dbs[db][k] = v
+	s.touch(db, k)
+}
+
+// Record the modification of the set or sorted set if n members were added or
+// removed, and delete it if it is empty, as Redis does.
+func (s *Server) modified(db int, k string, v *value, n int) {
+	if n > 0 {
+		s.touch(db, k)
+	}
+	if (v.set != nil && len(v.set) == 0) || (v.zset != nil && len(v.zset) == 0) {
+		delete(s.dbs[db], k)
+	}
+}
+
+// Increment the modification counter of the key.
+func (s *Server) touch(db int, k string) {
+	s.vers[s.versionKey(db, k)]++
+}
+
+// Get the key of the modification counter of the key in the database.
+func (s *Server) versionKey(db int, k string) string {
+	return strconv.Itoa(db) + ":" + k
+}
+
+// Split the key of the modification counter into the database and the key.
+func splitVersionKey(key string) (int, string) {
+	i := strings.Index(key, ":")
+	db, _ := strconv.Atoi(key[:i])
+	return db, key[i+1:]
+}
+
+// Get the expiration time in the specified number of seconds.
+func expiration(secs int) time.Time {
+	return time.Now().Add(time.Duration(secs) * time.Second)
+}
+
+// Parse a score, including the infinite values.
+func parseScore(v string) (float64, error) {
+	switch strings.ToLower(v) {
+	case "-inf":
+		return math.Inf(-1), nil
+	case "+inf", "inf":
+		return math.Inf(1), nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, errNotFloat
+	}
+	return f, nil
+}
+
+// Get the error for a wrong number of arguments.
+func errArgs(cmd string) error {
+	return fmt.Errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd))
+}
+
+// Get the error as reply, or 0 if there is no error.
+func errOrZero(err error) interface{} {
+	if err != nil {
+		return err
+	}
+	return 0
+}
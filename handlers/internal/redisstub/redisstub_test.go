@@ -0,0 +1,60 @@
+package redisstub
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestScanDeleteBetweenCalls(t *testing.T) {
+	srv, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	conn, err := redis.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	const n = 10
+	for i := 0; i < n; i++ {
+		if _, err := conn.Do("SET", fmt.Sprintf("k%02d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Delete the keys returned by each call before the next one, the other keys
+	// must not be skipped.
+	seen := make(map[string]bool)
+	cursor := 0
+	for {
+		vals, err := redis.Values(conn.Do("SCAN", cursor, "COUNT", 3))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cursor, err = redis.Int(vals[0], nil); err != nil {
+			t.Fatal(err)
+		}
+		keys, err := redis.Strings(vals[1], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range keys {
+			seen[k] = true
+			if _, err := conn.Do("DEL", k); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	if len(seen) != n {
+		t.Errorf("expected %d keys to be returned, got %d", n, len(seen))
+	}
+	if keys := srv.Keys(0); len(keys) != 0 {
+		t.Errorf("expected no keys left, got %v", keys)
+	}
+}
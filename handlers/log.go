@@ -4,7 +4,12 @@ package handlers
 // https://github.com/senchalabs/connect
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"regexp"
 	"strings"
@@ -21,6 +26,8 @@ const (
 )
 
 var (
+	ErrDuplicateLogField = errors.New("log field name is used by more than one token")
+
 	// Token parser for request and response headers
 	rxHeaders = regexp.MustCompile(`^(req|res)\[([^\]]+)\]$`)
 
@@ -70,7 +77,15 @@ func (this *statusResponseWriter) WrappedWriter() http.ResponseWriter {
 	return this.ResponseWriter
 }
 
-// LogHandler options
+// LogHandler options. If JSONWriter or SlogHandler is set, the request is logged in
+// a structured form instead of using the Format: each token (the Tokens, or those of
+// the predefined Format) is a named field, written as one JSON object per line to the
+// JSONWriter, or as the attributes of a record passed to the SlogHandler. The field
+// name of a token is its FieldNames entry, if any, otherwise the token itself, and
+// "req.<header>" or "res.<header>" (lowercase) for the request and response headers.
+// The field names must be unique, LogHandler panics otherwise. Each line is written
+// with a single call to Write, the JSONWriter must be safe for concurrent use (e.g.
+// an *os.File).
 type LogOptions struct {
 	LogFn        func(string, ...interface{}) // Defaults to ghost.LogFn if nil
 	Format       string
@@ -78,6 +93,9 @@ type LogOptions struct {
 	CustomTokens map[string]func(http.ResponseWriter, *http.Request) string
 	Immediate    bool
 	DateFormat   string
+	JSONWriter   io.Writer         // Structured output, as JSON lines
+	SlogHandler  slog.Handler      // Structured output, as slog records (if JSONWriter is nil)
+	FieldNames   map[string]string // Field names of the tokens in structured output
 }
 
 // Create a new LogOptions struct. The DateFormat defaults to time.RFC3339.
@@ -100,6 +118,11 @@ func LogHandlerFunc(h http.HandlerFunc, opts *LogOptions) http.HandlerFunc {
 
 // Create a log handler for every request it receives.
 func LogHandler(h http.Handler, opts *LogOptions) http.HandlerFunc {
+	if opts.JSONWriter != nil || opts.SlogHandler != nil {
+		if err := validateFieldNames(opts); err != nil {
+			panic(err)
+		}
+	}
 	return func(w http.ResponseWriter, r *http.Request) {
 		if _, ok := getStatusWriter(w); ok {
 			// Self-awareness, logging handler already set up
@@ -184,10 +207,8 @@ func getPredefinedTokenValue(t string, w *statusResponseWriter, r *http.Request,
 // Do the actual logging.
 func logRequest(w *statusResponseWriter, r *http.Request, st time.Time, opts *LogOptions) {
 	var (
-		fn     func(string, ...interface{})
-		ok     bool
-		format string
-		toks   []string
+		fn func(string, ...interface{})
+		ok bool
 	)
 
 	// If no specific log function, use the default one from the ghost package
@@ -197,25 +218,109 @@ func logRequest(w *statusResponseWriter, r *http.Request, st time.Time, opts *Lo
 		fn = opts.LogFn
 	}
 
-	// If this is a predefined format, use it instead
-	if v, ok := predefFormats[opts.Format]; ok {
-		format = v.fmt
-		toks = v.toks
-	} else {
-		format = opts.Format
-		toks = opts.Tokens
-	}
+	format, toks := getFormat(opts)
+	structured := opts.JSONWriter != nil || opts.SlogHandler != nil
 	args := make([]interface{}, len(toks))
 	for i, t := range toks {
 		if args[i], ok = getPredefinedTokenValue(t, w, r, st, opts); !ok {
 			if f, ok := opts.CustomTokens[t]; ok && f != nil {
 				args[i] = f(w, r)
+			} else if structured {
+				args[i] = nil
 			} else {
 				args[i] = "?"
 			}
 		}
 	}
-	fn(format, args...)
+
+	switch {
+	case opts.JSONWriter != nil:
+		logJSON(toks, args, opts)
+	case opts.SlogHandler != nil:
+		logSlog(r, toks, args, opts)
+	default:
+		fn(format, args...)
+	}
+}
+
+// Get the format and the tokens to log. If this is a predefined format, use it
+// instead of the Tokens.
+func getFormat(opts *LogOptions) (string, []string) {
+	if v, ok := predefFormats[opts.Format]; ok {
+		return v.fmt, v.toks
+	}
+	return opts.Format, opts.Tokens
+}
+
+// Check that each token has its own field name in structured output, otherwise the
+// JSON objects would have duplicate keys.
+func validateFieldNames(opts *LogOptions) error {
+	_, toks := getFormat(opts)
+	seen := make(map[string]string, len(toks))
+	for _, t := range toks {
+		nm := getFieldName(t, opts)
+		if prev, ok := seen[nm]; ok {
+			return fmt.Errorf("%w : %q, by %q and %q", ErrDuplicateLogField, nm, prev, t)
+		}
+		seen[nm] = t
+	}
+	return nil
+}
+
+// Get the field name of the token in structured output.
+func getFieldName(t string, opts *LogOptions) string {
+	if nm, ok := opts.FieldNames[t]; ok {
+		return nm
+	}
+	if mtch := rxHeaders.FindStringSubmatch(t); len(mtch) > 2 {
+		return mtch[1] + "." + strings.ToLower(mtch[2])
+	}
+	return t
+}
+
+// Write the tokens as a JSON object on a single line, the fields are in the
+// order of the tokens.
+func logJSON(toks []string, args []interface{}, opts *LogOptions) {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte('{')
+	for i, t := range toks {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(getFieldName(t, opts))
+		if err != nil {
+			ghost.LogFn("ghost.log : error encoding field name : %s", err)
+			return
+		}
+		v, err := json.Marshal(args[i])
+		if err != nil {
+			ghost.LogFn("ghost.log : error encoding field %s : %s", t, err)
+			return
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteString("}\n")
+
+	if _, err := opts.JSONWriter.Write(buf.Bytes()); err != nil {
+		ghost.LogFn("ghost.log : error writing log : %s", err)
+	}
+}
+
+// Pass the tokens as the attributes of a record to the slog handler.
+func logSlog(r *http.Request, toks []string, args []interface{}, opts *LogOptions) {
+	ctx := r.Context()
+	if !opts.SlogHandler.Enabled(ctx, slog.LevelInfo) {
+		return
+	}
+	rec := slog.NewRecord(time.Now(), slog.LevelInfo, "request", 0)
+	for i, t := range toks {
+		rec.AddAttrs(slog.Any(getFieldName(t, opts), args[i]))
+	}
+	if err := opts.SlogHandler.Handle(ctx, rec); err != nil {
+		ghost.LogFn("ghost.log : error writing log : %s", err)
+	}
 }
 
 // Helper function to retrieve the status writer.
@@ -2,8 +2,12 @@ package handlers
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"regexp"
@@ -215,3 +219,73 @@ func TestCustom(t *testing.T) {
 	rx := regexp.MustCompile(`GET toto`)
 	assertTrue(rx.MatchString(ac), fmt.Sprintf("expected log to match '%s', got '%s'", rx.String(), ac), t)
 }
+
+func doStructuredLogRequest(opts *LogOptions, t *testing.T) {
+	opts.CustomTokens["custom"] = func(w http.ResponseWriter, r *http.Request) string {
+		return "toto"
+	}
+	h := LogHandler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(201)
+			w.Write([]byte("body"))
+		}), opts)
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	req, err := http.NewRequest("GET", s.URL+"/a?b=c", nil)
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("X-Request-Id", "abc")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	assertStatus(http.StatusCreated, res.StatusCode, t)
+}
+
+func TestStructuredLogJSON(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	opts := NewLogOptions(nil, "", "method", "url", "status", "response-time", "custom",
+		"req[X-Request-Id]", "res[Content-Type]", "bidon")
+	opts.JSONWriter = buf
+	opts.FieldNames = map[string]string{"status": "code", "req[X-Request-Id]": "request_id"}
+	doStructuredLogRequest(opts, t)
+
+	ac := buf.String()
+	rx := regexp.MustCompile(`^\{"method":"GET","url":"/a\?b=c","code":201,"response-time":[0-9.e-]+,"custom":"toto","request_id":"abc","res\.content-type":"text/plain","bidon":null\}\n$`)
+	assertTrue(rx.MatchString(ac), fmt.Sprintf("expected log to match '%s', got '%s'", rx.String(), ac), t)
+}
+
+func TestStructuredLogDuplicateField(t *testing.T) {
+	defer func() {
+		e := recover()
+		err, ok := e.(error)
+		assertTrue(ok && errors.Is(err, ErrDuplicateLogField), fmt.Sprintf("expected ErrDuplicateLogField, got %v", e), t)
+	}()
+	opts := NewLogOptions(nil, "", "status", "method")
+	opts.JSONWriter = ioutil.Discard
+	opts.FieldNames = map[string]string{"method": "status"}
+	LogHandler(http.NotFoundHandler(), opts)
+}
+
+func TestStructuredLogSlog(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	opts := NewLogOptions(nil, Ltiny)
+	opts.SlogHandler = slog.NewJSONHandler(buf, nil)
+	doStructuredLogRequest(opts, t)
+
+	var rec map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		panic(err)
+	}
+	assertTrue(rec["msg"] == "request", fmt.Sprintf("expected msg to be 'request', got %v", rec["msg"]), t)
+	assertTrue(rec["method"] == "GET", fmt.Sprintf("expected method to be 'GET', got %v", rec["method"]), t)
+	assertTrue(rec["url"] == "/a?b=c", fmt.Sprintf("expected url to be '/a?b=c', got %v", rec["url"]), t)
+	assertTrue(rec["status"] == float64(201), fmt.Sprintf("expected status to be 201, got %v", rec["status"]), t)
+	_, ok := rec["response-time"].(float64)
+	assertTrue(ok, fmt.Sprintf("expected response-time to be a number, got %v", rec["response-time"]), t)
+	_, ok = rec["res.content-length"]
+	assertTrue(ok, "expected a res.content-length field", t)
+}
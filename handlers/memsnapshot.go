@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"context"
+	"encoding/gob"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// The content of a snapshot file of a memory store.
+type memorySnapshot struct {
+	Entries []memorySnapshotEntry // From the most to the least recently used
+}
+
+// A session in a snapshot file, with its absolute expiration time.
+type memorySnapshotEntry struct {
+	ID      string
+	Owner   string // Empty if the session is not associated with an owner
+	Expires time.Time
+	Session []byte // Encoded with the codec of the store
+}
+
+// Save all sessions that are not expired to the snapshot file, with their expiration
+// time and owner. The file is written to a temporary file and then renamed, so that
+// it is never partially written.
+func (this *MemoryStore) SaveSnapshot(fn string) error {
+	snap, err := this.snapshot()
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(fn), ".tmp-")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if err = gob.NewEncoder(f).Encode(snap); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, fn)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// Load the sessions of the snapshot file into the store, and return the number of
+// sessions loaded. The sessions keep their expiration time, so those that expired
+// since the snapshot was saved are dropped. If the file does not exist, the error
+// satisfies os.IsNotExist.
+func (this *MemoryStore) LoadSnapshot(fn string) (int, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var snap memorySnapshot
+	if err = gob.NewDecoder(f).Decode(&snap); err != nil {
+		return 0, err
+	}
+	// Decode the sessions before changing the store
+	c := getCodec(this.opts.Codec)
+	now := time.Now()
+	sessions := make([]*Session, len(snap.Entries))
+	for i, ent := range snap.Entries {
+		if !now.Before(ent.Expires) {
+			continue
+		}
+		if sessions[i], err = c.Decode(ent.Session); err != nil {
+			return 0, err
+		}
+	}
+
+	this.l.Lock()
+	defer this.l.Unlock()
+	n := 0
+	// From the least to the most recently used, so that the LRU order is kept
+	for i := len(snap.Entries) - 1; i >= 0; i-- {
+		sess, ent := sessions[i], snap.Entries[i]
+		if sess == nil {
+			continue
+		}
+		sess.isNew = false
+		if el, ok := this.m[ent.ID]; ok {
+			this.remove(el)
+		}
+		this.m[ent.ID] = this.lru.PushFront(&memoryEntry{ent.ID, sess, ent.Expires})
+		if ent.Owner != "" {
+			ids, ok := this.index[ent.Owner]
+			if !ok {
+				ids = make(map[string]struct{})
+				this.index[ent.Owner] = ids
+			}
+			ids[ent.ID] = struct{}{}
+			this.owners[ent.ID] = ent.Owner
+		}
+		n++
+	}
+	for this.opts.MaxLen > 0 && this.lru.Len() > this.opts.MaxLen {
+		this.remove(this.lru.Back())
+	}
+	return n, nil
+}
+
+// Get the snapshot of the sessions of the store that are not expired.
+func (this *MemoryStore) snapshot() (*memorySnapshot, error) {
+	c := getCodec(this.opts.Codec)
+	this.l.Lock()
+	defer this.l.Unlock()
+	now := time.Now()
+	snap := &memorySnapshot{Entries: make([]memorySnapshotEntry, 0, this.lru.Len())}
+	for el := this.lru.Front(); el != nil; el = el.Next() {
+		ent := el.Value.(*memoryEntry)
+		if !now.Before(ent.exp) {
+			continue
+		}
+		b, err := c.Encode(ent.sess)
+		if err != nil {
+			return nil, err
+		}
+		snap.Entries = append(snap.Entries, memorySnapshotEntry{ent.id, this.owners[ent.id], ent.exp, b})
+	}
+	return snap, nil
+}
+
+// ServeWithSnapshot loads the sessions of the memory store from the snapshot file,
+// if it exists, and serves HTTP requests with the server (on its Addr) until the
+// process receives an interrupt or terminate signal. The server is then shut down
+// gracefully, waiting for the active requests for up to the timeout, and the sessions
+// are saved to the snapshot file. The sessions are also saved if the server fails.
+func ServeWithSnapshot(srv *http.Server, ms *MemoryStore, fn string, timeout time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	addr := srv.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return serveWithSnapshot(ctx, srv, ln, ms, fn, timeout)
+}
+
+// Serve with the snapshot of the memory store until the context is done.
+func serveWithSnapshot(ctx context.Context, srv *http.Server, ln net.Listener, ms *MemoryStore,
+	fn string, timeout time.Duration) error {
+
+	if _, err := ms.LoadSnapshot(fn); err != nil && !os.IsNotExist(err) {
+		ln.Close()
+		return err
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(ln)
+	}()
+	var err error
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		sctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		err = srv.Shutdown(sctx)
+	}
+	if serr := ms.SaveSnapshot(fn); err == nil {
+		err = serr
+	}
+	return err
+}
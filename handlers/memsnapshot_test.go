@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreSnapshot(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "sessions.snap")
+	ms := NewMemoryStore(1)
+	defer ms.Close()
+
+	s1, s2, s3 := newSession(3600), newSession(0), newSession(0)
+	s1.Set("foo", "bar")
+	s2.internalSession.MaxAge = 50 * time.Millisecond
+	s3.internalSession.MaxAge = 300 * time.Millisecond
+	for _, s := range []*Session{s1, s2, s3} {
+		ms.Set(s)
+	}
+	ms.Associate("me", s1.ID())
+	if err := ms.SaveSnapshot(fn); err != nil {
+		panic(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Sessions expired while down are dropped
+	ms2 := NewMemoryStore(1)
+	defer ms2.Close()
+	n, err := ms2.LoadSnapshot(fn)
+	assertTrue(err == nil, fmt.Sprintf("expected no error, got %v", err), t)
+	assertTrue(n == 2, fmt.Sprintf("expected 2 sessions loaded, got %d", n), t)
+	ssn, _ := ms2.Get(s1.ID())
+	if assertTrue(ssn != nil, "expected session 1 to be loaded", t) {
+		assertTrue(ssn.Get("foo") == "bar", fmt.Sprintf("expected foo to be bar, got %v", ssn.Get("foo")), t)
+		assertTrue(!ssn.IsNew(), "expected loaded session not to be new", t)
+	}
+	ssn, _ = ms2.Get(s2.ID())
+	assertTrue(ssn == nil, "expected expired session 2 to be dropped", t)
+	ids, _ := ms2.OwnerSessions("me")
+	assertTrue(len(ids) == 1 && ids[0] == s1.ID(), fmt.Sprintf("expected owner of session 1 to be loaded, got %v", ids), t)
+
+	// The remaining time to live is kept
+	ssn, _ = ms2.Get(s3.ID())
+	assertTrue(ssn != nil, "expected session 3 to be loaded", t)
+	time.Sleep(250 * time.Millisecond)
+	ssn, _ = ms2.Get(s3.ID())
+	assertTrue(ssn == nil, "expected session 3 to expire at its original time", t)
+
+	// Missing snapshot
+	_, err = ms2.LoadSnapshot(fn + ".missing")
+	assertTrue(os.IsNotExist(err), fmt.Sprintf("expected not exist error, got %v", err), t)
+}
+
+func TestServeWithSnapshot(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "sessions.snap")
+	serve := func(ms *MemoryStore) (string, func() error) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			panic(err)
+		}
+		srv := &http.Server{Handler: SessionHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ssn, _ := GetSession(w)
+			w.Write([]byte(ssn.ID()))
+		}, NewSessionOptions(ms, secret))}
+		ctx, cancel := context.WithCancel(context.Background())
+		errc := make(chan error, 1)
+		go func() {
+			errc <- serveWithSnapshot(ctx, srv, ln, ms, fn, time.Second)
+		}()
+		return "http://" + ln.Addr().String(), func() error {
+			cancel()
+			return <-errc
+		}
+	}
+
+	// 1st run, create a session
+	ms := NewMemoryStore(1)
+	defer ms.Close()
+	u, stop := serve(ms)
+	res, id1 := doRequestWithCookie(u, nil)
+	ck := res.Cookies()[0]
+	err := stop()
+	assertTrue(err == nil, fmt.Sprintf("expected no error, got %v", err), t)
+
+	// 2nd run, the session is restored
+	ms2 := NewMemoryStore(1)
+	defer ms2.Close()
+	u, stop = serve(ms2)
+	_, id2 := doRequestWithCookie(u, ck)
+	stop()
+	assertTrue(id1 == id2, "expected session to be restored, got a new one", t)
+}
@@ -1,15 +1,46 @@
 package handlers
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
 
+const (
+	defaultRedisMaxIdle           = 10
+	defaultRedisScanCount         = 100
+	defaultRedisHealthCheckPeriod = time.Minute
+
+	// Suffix of the key of the sorted set that indexes the session IDs by expiration
+	// time, used to count the sessions.
+	redisIndexKeySuffix = "_index"
+
+	// Prefix of the keys of the sets of session IDs by owner, after the key prefix.
+	redisOwnerKeyPrefix = "_owner:"
+
+	// Prefix of the keys of the owners by session ID, after the key prefix.
+	redisSessOwnerKeyPrefix = "_sessowner:"
+
+	// Time to live of the association of a session ID that is not saved yet. It is
+	// extended to the time to live of the session when the session is saved.
+	redisOwnerGracePeriod = time.Minute
+
+	// Maximum number of expired session IDs removed from the index by a write.
+	redisIndexPruneCount = 10
+
+	// Number of attempts of a transaction on watched keys, when the keys are
+	// modified concurrently.
+	redisWatchAttempts = 3
+)
+
 var (
 	ErrNoKeyPrefix = errors.New("cannot get session keys without a key prefix")
+
+	errUnexpectedReply = errors.New("unexpected reply from the Redis server")
 )
 
 type RedisStoreOptions struct {
@@ -21,115 +52,678 @@ type RedisStoreOptions struct {
 	Database             int           // Redis database to use for session keys
 	KeyPrefix            string        // If set, keys will be KeyPrefix:SessionID (semicolon added)
 	BrowserSessServerTTL time.Duration // Defaults to 2 days
+	MaxIdle              int           // Max idle connections in the pool, defaults to 10
+	MaxActive            int           // Max connections in the pool, 0 means no limit
+	IdleTimeout          time.Duration // Close connections idle for this duration, 0 means never
+	Wait                 bool          // If true, wait for a connection when MaxActive is reached
+	HealthCheckPeriod    time.Duration // Check idle connections with a PING if unused for this duration, defaults to 1 minute, negative means always
+	ScanCount            int           // Number of keys scanned and deleted per batch by Clear, defaults to 100
+	Codec                SessionCodec  // Encoding of the sessions, defaults to JSONCodec
 }
 
+// Redis implementation of a session store. It uses a pool of connections, so it
+// is safe for concurrent use.
 type RedisStore struct {
 	opts *RedisStoreOptions
-	conn redis.Conn
+	pool *redis.Pool
 }
 
-// Create a redis session store with the specified options.
-func NewRedisStore(opts *RedisStoreOptions) *RedisStore {
-	var err error
-	rs := &RedisStore{opts, nil}
-	rs.conn, err = redis.DialTimeout(opts.Network, opts.Address, opts.ConnectTimeout,
-		opts.ReadTimeout, opts.WriteTimeout)
-	if err != nil {
-		panic(err)
+// Create a redis session store with the specified options. It returns an error
+// if the connection to the Redis server fails.
+func NewRedisStore(opts *RedisStoreOptions) (*RedisStore, error) {
+	maxIdle := opts.MaxIdle
+	if maxIdle == 0 {
+		maxIdle = defaultRedisMaxIdle
+	}
+	checkPeriod := opts.HealthCheckPeriod
+	if checkPeriod == 0 {
+		checkPeriod = defaultRedisHealthCheckPeriod
 	}
-	return rs
+	rs := &RedisStore{opts, &redis.Pool{
+		Dial:        opts.dial,
+		MaxIdle:     maxIdle,
+		MaxActive:   opts.MaxActive,
+		IdleTimeout: opts.IdleTimeout,
+		Wait:        opts.Wait,
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < checkPeriod {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}}
+	// Make sure the server can be reached
+	conn := rs.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		rs.pool.Close()
+		return nil, err
+	}
+	return rs, nil
 }
 
-// Get the session from the store.
-func (this *RedisStore) Get(id string) (*Session, error) {
-	key := id
-	if this.opts.KeyPrefix != "" {
-		key = this.opts.KeyPrefix + ":" + id
-	}
-	b, err := redis.Bytes(this.conn.Do("GET", key))
+// Open a new connection to the Redis server, on the configured database.
+func (this *RedisStoreOptions) dial() (redis.Conn, error) {
+	conn, err := redis.DialTimeout(this.Network, this.Address, this.ConnectTimeout,
+		this.ReadTimeout, this.WriteTimeout)
 	if err != nil {
 		return nil, err
 	}
-	var sess Session
-	err = json.Unmarshal(b, &sess)
+	if this.Database != 0 {
+		if _, err := conn.Do("SELECT", this.Database); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Get the session from the store.
+func (this *RedisStore) Get(id string) (*Session, error) {
+	return this.GetContext(context.Background(), id)
+}
+
+// Get the session from the store, or return the error of the context if it is
+// done before the reply is received.
+func (this *RedisStore) GetContext(ctx context.Context, id string) (*Session, error) {
+	b, err := redis.Bytes(this.doContext(ctx, "GET", this.getKey(id)))
 	if err != nil {
+		if err == redis.ErrNil {
+			// Not in the store, or expired
+			return nil, nil
+		}
 		return nil, err
 	}
-	return &sess, nil
+	return getCodec(this.opts.Codec).Decode(b)
 }
 
-// Save the session into the store.
+// Save the session into the store. If a key prefix is set, the session ID is also
+// added to the index used to count the sessions.
 func (this *RedisStore) Set(sess *Session) error {
-	b, err := json.Marshal(sess)
+	return this.SetContext(context.Background(), sess)
+}
+
+// Save the session into the store, or return the error of the context if it is
+// done before the reply is received.
+func (this *RedisStore) SetContext(ctx context.Context, sess *Session) error {
+	b, err := getCodec(this.opts.Codec).Encode(sess)
 	if err != nil {
 		return err
 	}
-	key := sess.ID()
-	if this.opts.KeyPrefix != "" {
-		key = this.opts.KeyPrefix + ":" + sess.ID()
+	ttl := sessionTTL(sess, this.opts.BrowserSessServerTTL)
+	return this.withConnContext(ctx, true, func(conn redis.Conn) error {
+		idx, err := this.readIndexes(conn, sess.ID())
+		if err != nil {
+			return err
+		}
+		conn.Send("MULTI")
+		conn.Send("SETEX", this.getKey(sess.ID()), int(ttl.Seconds()), b)
+		this.sendIndex(conn, sess.ID(), ttl, idx)
+		_, err = conn.Do("EXEC")
+		return err
+	})
+}
+
+// Save the session into the store if the version of the stored session is the
+// specified version. The key of the session is watched while its version is checked,
+// so that the transaction fails if the session is saved concurrently, in which case
+// it is checked again.
+func (this *RedisStore) CompareAndSet(sess *Session, version int64) (bool, error) {
+	return this.CompareAndSetContext(context.Background(), sess, version)
+}
+
+// Save the session into the store if the version of the stored session is the
+// specified version, or return the error of the context if it is done before the
+// reply is received.
+func (this *RedisStore) CompareAndSetContext(ctx context.Context, sess *Session, version int64) (bool, error) {
+	c := getCodec(this.opts.Codec)
+	b, err := c.Encode(sess)
+	if err != nil {
+		return false, err
 	}
-	ttl := sess.MaxAge()
-	if ttl == 0 {
-		// Browser session, set to specified TTL
-		ttl = this.opts.BrowserSessServerTTL
-		if ttl == 0 {
-			ttl = 2 * 24 * time.Hour // Default to 2 days
+	key, ttl := this.getKey(sess.ID()), sessionTTL(sess, this.opts.BrowserSessServerTTL)
+	var ok bool
+	err = this.withConnContext(ctx, false, func(conn redis.Conn) error {
+		for i := 0; i < redisWatchAttempts; i++ {
+			ok = false
+			if _, err := conn.Do("WATCH", key); err != nil {
+				return err
+			}
+			var cur int64
+			old, err := redis.Bytes(conn.Do("GET", key))
+			if err == nil {
+				oldSess, err := c.Decode(old)
+				if err != nil {
+					conn.Do("UNWATCH")
+					return err
+				}
+				cur = oldSess.Version()
+			} else if err != redis.ErrNil {
+				return err
+			}
+			if cur != version {
+				_, err = conn.Do("UNWATCH")
+				return err
+			}
+			idx, err := this.readIndexes(conn, sess.ID())
+			if err != nil {
+				return err
+			}
+			conn.Send("MULTI")
+			conn.Send("SETEX", key, int(ttl.Seconds()), b)
+			this.sendIndex(conn, sess.ID(), ttl, idx)
+			res, err := conn.Do("EXEC")
+			if err != nil || res != nil {
+				ok = err == nil
+				return err
+			}
+			// Nil reply, the key was modified (i.e. touched), check the version again
 		}
+		return nil
+	})
+	if err != nil {
+		// The function may still be running if the context is done
+		return false, err
 	}
-	_, err = this.conn.Do("SETEX", key, int(ttl.Seconds()), b)
+	return ok, nil
+}
+
+// Save the session into the store if id is in the store, and delete id if it is not
+// the ID of the session. The key of id is watched while its existence is checked, so
+// that the transaction fails if it is saved or deleted concurrently, in which case it
+// is checked again.
+func (this *RedisStore) Replace(sess *Session, id string) (bool, error) {
+	return this.ReplaceContext(context.Background(), sess, id)
+}
+
+// Save the session into the store if id is in the store, or return the error of the
+// context if it is done before the reply is received.
+func (this *RedisStore) ReplaceContext(ctx context.Context, sess *Session, id string) (bool, error) {
+	b, err := getCodec(this.opts.Codec).Encode(sess)
 	if err != nil {
-		return err
+		return false, err
+	}
+	key, ttl := this.getKey(id), sessionTTL(sess, this.opts.BrowserSessServerTTL)
+	var ok bool
+	err = this.withConnContext(ctx, false, func(conn redis.Conn) error {
+		for i := 0; i < redisWatchAttempts; i++ {
+			ok = false
+			if _, err := conn.Do("WATCH", key); err != nil {
+				return err
+			}
+			exists, err := redis.Bool(conn.Do("EXISTS", key))
+			if err != nil {
+				return err
+			}
+			if !exists {
+				_, err = conn.Do("UNWATCH")
+				return err
+			}
+			idx, err := this.readIndexes(conn, sess.ID())
+			if err != nil {
+				return err
+			}
+			var owner string
+			if id != sess.ID() {
+				// The new ID must be associated again, the old one is removed
+				if owner, err = this.readOwner(conn, id); err != nil {
+					return err
+				}
+			}
+			conn.Send("MULTI")
+			if id != sess.ID() {
+				conn.Send("DEL", key)
+				this.sendUnindex(conn, id, owner)
+			}
+			conn.Send("SETEX", this.getKey(sess.ID()), int(ttl.Seconds()), b)
+			this.sendIndex(conn, sess.ID(), ttl, idx)
+			res, err := conn.Do("EXEC")
+			if err != nil || res != nil {
+				ok = err == nil
+				return err
+			}
+			// Nil reply, the key was modified, try again
+		}
+		return ErrSessionConflict
+	})
+	if err != nil {
+		return false, err
 	}
-	return nil
+	return ok, nil
+}
+
+// Reset the expiration and save the last access time of the session, without
+// saving its content. The stored session is updated in a transaction that fails if
+// it is saved or deleted concurrently, in which case it is not touched.
+func (this *RedisStore) Touch(sess *Session) error {
+	return this.TouchContext(context.Background(), sess)
+}
+
+// Reset the expiration and save the last access time of the session, or return the
+// error of the context if it is done before the reply is received.
+func (this *RedisStore) TouchContext(ctx context.Context, sess *Session) error {
+	c := getCodec(this.opts.Codec)
+	key, ttl := this.getKey(sess.ID()), sessionTTL(sess, this.opts.BrowserSessServerTTL)
+	return this.withConnContext(ctx, true, func(conn redis.Conn) error {
+		if _, err := conn.Do("WATCH", key); err != nil {
+			return err
+		}
+		b, err := redis.Bytes(conn.Do("GET", key))
+		if err != nil {
+			conn.Do("UNWATCH")
+			if err == redis.ErrNil {
+				// Not in the store, it is not created again
+				return nil
+			}
+			return err
+		}
+		stored, err := c.Decode(b)
+		if err == nil {
+			stored.internalSession.LastAccess = sess.internalSession.LastAccess
+			b, err = c.Encode(stored)
+		}
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+		idx, err := this.readIndexes(conn, sess.ID())
+		if err != nil {
+			return err
+		}
+		conn.Send("MULTI")
+		conn.Send("SETEX", key, int(ttl.Seconds()), b)
+		this.sendIndex(conn, sess.ID(), ttl, idx)
+		// A nil reply means that the session was saved or deleted concurrently
+		_, err = conn.Do("EXEC")
+		return err
+	})
 }
 
 // Delete the session from the store.
 func (this *RedisStore) Delete(id string) error {
-	key := id
-	if this.opts.KeyPrefix != "" {
-		key = this.opts.KeyPrefix + ":" + id
-	}
-	_, err := this.conn.Do("DEL", key)
-	if err != nil {
+	return this.DeleteContext(context.Background(), id)
+}
+
+// Delete the session from the store, or return the error of the context if it is
+// done before the reply is received.
+func (this *RedisStore) DeleteContext(ctx context.Context, id string) error {
+	return this.withConnContext(ctx, true, func(conn redis.Conn) error {
+		owner, err := this.readOwner(conn, id)
+		if err != nil {
+			return err
+		}
+		conn.Send("MULTI")
+		conn.Send("DEL", this.getKey(id))
+		this.sendUnindex(conn, id, owner)
+		_, err = conn.Do("EXEC")
 		return err
-	}
-	return nil
+	})
 }
 
 // Clear all sessions from the store. Requires the use of a key
 // prefix in the store options, otherwise the method refuses to delete all keys.
+// The keys are iterated using SCAN and deleted in batches, so that the Redis
+// server is not blocked.
 func (this *RedisStore) Clear() error {
-	vals, err := this.getSessionKeys()
-	if err != nil {
-		return err
+	if this.opts.KeyPrefix == "" {
+		return ErrNoKeyPrefix
+	}
+	count := this.opts.ScanCount
+	if count <= 0 {
+		count = defaultRedisScanCount
 	}
-	if len(vals) > 0 {
-		this.conn.Send("MULTI")
-		for _, v := range vals {
-			this.conn.Send("DEL", v)
+	conn := this.pool.Get()
+	defer conn.Close()
+
+	cursor := 0
+	for {
+		vals, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", this.opts.KeyPrefix+":*", "COUNT", count))
+		if err != nil {
+			return err
 		}
-		_, err = this.conn.Do("EXEC")
+		if len(vals) != 2 {
+			return errUnexpectedReply
+		}
+		cursor, err = redis.Int(vals[0], nil)
 		if err != nil {
 			return err
 		}
+		keys, err := redis.Values(vals[1], nil)
+		if err != nil {
+			return err
+		}
+		// SCAN's count is only a hint, make sure the batches are bounded
+		for len(keys) > 0 {
+			n := count
+			if n > len(keys) {
+				n = len(keys)
+			}
+			if _, err = conn.Do("DEL", keys[:n]...); err != nil {
+				return err
+			}
+			keys = keys[n:]
+		}
+		if cursor == 0 {
+			return nil
+		}
 	}
-	return nil
 }
 
-// Get the number of session keys in the store. Requires the use of a
+// Get the approximate number of sessions in the store. Requires the use of a
 // key prefix in the store options, otherwise returns -1 (cannot tell
-// session keys from other keys).
+// session keys from other keys). The sessions are counted using an index of
+// their expiration times maintained by the store, so it is cheap, but the count
+// is approximate: sessions deleted without going through the store are still
+// counted until they expire.
 func (this *RedisStore) Len() int {
-	vals, err := this.getSessionKeys()
+	return this.LenContext(context.Background())
+}
+
+// Get the approximate number of sessions in the store, or -1 if the context is done
+// before the reply is received.
+func (this *RedisStore) LenContext(ctx context.Context) int {
+	if this.opts.KeyPrefix == "" {
+		return -1
+	}
+	// The expired IDs are removed from the index by the writes, only count the others
+	n, err := redis.Int(this.doContext(ctx, "ZCOUNT", this.getKey(redisIndexKeySuffix), time.Now().Unix()+1, "+inf"))
 	if err != nil {
 		return -1
 	}
-	return len(vals)
+	return n
+}
+
+// Associate the session ID with the owner, by adding it to the set of the session
+// IDs of the owner. A session has only one owner, it is removed from the set of its
+// previous owner, if any. The association expires with the session, or after a grace
+// period if the session is not saved yet.
+func (this *RedisStore) Associate(owner, id string) error {
+	return this.withConn(true, func(conn redis.Conn) error {
+		key, sessOwnerKey := this.getKey(redisOwnerKeyPrefix+owner), this.getKey(redisSessOwnerKeyPrefix+id)
+		conn.Send("GET", sessOwnerKey)
+		conn.Send("TTL", this.getKey(id))
+		conn.Send("TTL", key)
+		conn.Flush()
+		prev, err := redis.String(conn.Receive())
+		if err != nil && err != redis.ErrNil {
+			return err
+		}
+		ttl, err := redis.Int64(conn.Receive())
+		if err != nil {
+			return err
+		}
+		ownerTTL, err := redis.Int64(conn.Receive())
+		if err != nil {
+			return err
+		}
+		if ttl < 0 {
+			// Not saved yet
+			ttl = int64(redisOwnerGracePeriod.Seconds())
+		}
+		conn.Send("MULTI")
+		if prev != "" && prev != owner {
+			conn.Send("SREM", this.getKey(redisOwnerKeyPrefix+prev), id)
+		}
+		conn.Send("SADD", key, id)
+		conn.Send("SETEX", sessOwnerKey, ttl, owner)
+		if ownerTTL < ttl {
+			conn.Send("EXPIRE", key, ttl)
+		}
+		_, err = conn.Do("EXEC")
+		return err
+	})
+}
+
+// Check if the session ID is in the set of the session IDs of the owner, whether
+// the session is in the store or not.
+func (this *RedisStore) IsOwner(owner, id string) (bool, error) {
+	return redis.Bool(this.doContext(context.Background(), "SISMEMBER", this.getKey(redisOwnerKeyPrefix+owner), id))
+}
+
+// Get the IDs of the sessions of the owner that are in the store. The IDs whose
+// session and association both expired are removed from the set of the owner (an
+// ID associated before its session is saved is kept during the grace period).
+func (this *RedisStore) OwnerSessions(owner string) ([]string, error) {
+	var res []string
+	err := this.withConn(true, func(conn redis.Conn) error {
+		key := this.getKey(redisOwnerKeyPrefix + owner)
+		if _, err := conn.Do("WATCH", key); err != nil {
+			return err
+		}
+		ids, err := redis.Strings(conn.Do("SMEMBERS", key))
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			conn.Send("EXISTS", this.getKey(id))
+			conn.Send("EXISTS", this.getKey(redisSessOwnerKeyPrefix+id))
+		}
+		conn.Flush()
+		res = res[:0]
+		var stale []interface{}
+		for _, id := range ids {
+			ok, err := redis.Bool(conn.Receive())
+			if err != nil {
+				return err
+			}
+			associated, err := redis.Bool(conn.Receive())
+			if err != nil {
+				return err
+			}
+			if ok {
+				res = append(res, id)
+			} else if !associated {
+				stale = append(stale, id)
+			}
+		}
+		if len(stale) == 0 {
+			_, err = conn.Do("UNWATCH")
+			return err
+		}
+		// If the set is modified concurrently, the IDs are removed by a later call
+		conn.Send("MULTI")
+		conn.Send("SREM", append([]interface{}{key}, stale...)...)
+		_, err = conn.Do("EXEC")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// Delete all sessions of the owner from the store, and the set of the session IDs
+// of the owner. The set is watched, so that a session associated concurrently is
+// also deleted.
+func (this *RedisStore) DeleteOwnerSessions(owner string) error {
+	return this.withConn(true, func(conn redis.Conn) error {
+		key := this.getKey(redisOwnerKeyPrefix + owner)
+		for i := 0; i < redisWatchAttempts; i++ {
+			if _, err := conn.Do("WATCH", key); err != nil {
+				return err
+			}
+			ids, err := redis.Strings(conn.Do("SMEMBERS", key))
+			if err != nil {
+				return err
+			}
+			conn.Send("MULTI")
+			for _, id := range ids {
+				conn.Send("DEL", this.getKey(id), this.getKey(redisSessOwnerKeyPrefix+id))
+				if this.opts.KeyPrefix != "" {
+					conn.Send("ZREM", this.getKey(redisIndexKeySuffix), id)
+				}
+			}
+			conn.Send("DEL", key)
+			res, err := conn.Do("EXEC")
+			if err != nil || res != nil {
+				return err
+			}
+			// Nil reply, the set was modified, try again
+		}
+		return ErrSessionConflict
+	})
+}
+
+// Close the pool of connections to the Redis server.
+func (this *RedisStore) Close() error {
+	return this.pool.Close()
+}
+
+// The state of the indexes of a session ID, read before a write of the session.
+type redisIndexes struct {
+	prune    int64  // Maximum expiration time of the expired IDs to remove from the index
+	owner    string // Owner of the session ID, if it is associated
+	ownerTTL int64  // Time to live of the set of the owner, in seconds
+}
+
+// Read the state of the indexes of the session ID. The expired IDs are removed from
+// the index in batches of redisIndexPruneCount, oldest first, instead of all at once
+// (IDs that expire at the same time are removed together, so a batch may be larger).
+func (this *RedisStore) readIndexes(conn redis.Conn, id string) (*redisIndexes, error) {
+	idx := &redisIndexes{prune: time.Now().Unix()}
+	if this.opts.KeyPrefix != "" {
+		conn.Send("ZRANGE", this.getKey(redisIndexKeySuffix),
+			redisIndexPruneCount-1, redisIndexPruneCount-1, "WITHSCORES")
+	}
+	conn.Send("GET", this.getKey(redisSessOwnerKeyPrefix+id))
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+	if this.opts.KeyPrefix != "" {
+		vals, err := redis.Strings(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+		if len(vals) == 2 {
+			// Score of the ID at the end of the batch
+			exp, err := strconv.ParseInt(vals[1], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			if exp < idx.prune {
+				idx.prune = exp
+			}
+		}
+	}
+	owner, err := redis.String(conn.Receive())
+	if err != nil {
+		if err == redis.ErrNil {
+			return idx, nil
+		}
+		return nil, err
+	}
+	idx.owner = owner
+	if idx.ownerTTL, err = redis.Int64(conn.Do("TTL", this.getKey(redisOwnerKeyPrefix+owner))); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// Read the owner of the session ID, or "" if it is not associated.
+func (this *RedisStore) readOwner(conn redis.Conn, id string) (string, error) {
+	owner, err := redis.String(conn.Do("GET", this.getKey(redisSessOwnerKeyPrefix+id)))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return owner, err
+}
+
+// Queue the commands to update the indexes when the session ID is saved with the
+// time to live: the expired IDs are removed from the index and the ID is added with
+// its expiration time, if a key prefix is set, and the association with its owner
+// expires with the session.
+func (this *RedisStore) sendIndex(conn redis.Conn, id string, ttl time.Duration, idx *redisIndexes) {
+	secs := int64(ttl.Seconds())
+	if this.opts.KeyPrefix != "" {
+		key := this.getKey(redisIndexKeySuffix)
+		conn.Send("ZREMRANGEBYSCORE", key, "-inf", idx.prune)
+		conn.Send("ZADD", key, time.Now().Unix()+secs, id)
+	}
+	if idx.owner != "" {
+		conn.Send("EXPIRE", this.getKey(redisSessOwnerKeyPrefix+id), secs)
+		// Only extend the set of the owner, it may have sessions that live longer. A
+		// concurrent write may still set a shorter time, until this session is saved again.
+		if idx.ownerTTL < secs {
+			conn.Send("EXPIRE", this.getKey(redisOwnerKeyPrefix+idx.owner), secs)
+		}
+	}
+}
+
+// Queue the commands to remove the session ID from the index and from the set of its
+// owner, if any.
+func (this *RedisStore) sendUnindex(conn redis.Conn, id, owner string) {
+	if this.opts.KeyPrefix != "" {
+		conn.Send("ZREM", this.getKey(redisIndexKeySuffix), id)
+	}
+	if owner != "" {
+		conn.Send("SREM", this.getKey(redisOwnerKeyPrefix+owner), id)
+		conn.Send("DEL", this.getKey(redisSessOwnerKeyPrefix+id))
+	}
+}
+
+// Execute the command on a connection from the pool, until the context is done.
+func (this *RedisStore) doContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	var res interface{}
+	err := this.withConnContext(ctx, true, func(conn redis.Conn) error {
+		var err error
+		res, err = conn.Do(cmd, args...)
+		return err
+	})
+	if err != nil {
+		// The function may still be running if the context is done, do not read res
+		return nil, err
+	}
+	return res, nil
+}
+
+// Call the function with a connection from the pool, until the context is done.
+// Redigo commands cannot be interrupted, so if the context is done first, the
+// function keeps running in the background and its connection is returned to
+// the pool when it completes (bounded by the ReadTimeout of the store).
+func (this *RedisStore) withConnContext(ctx context.Context, retry bool, fn func(redis.Conn) error) error {
+	if ctx.Done() == nil {
+		// Cannot be cancelled
+		return this.withConn(retry, fn)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- this.withConn(retry, fn)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Call the function with a connection from the pool. If retry is true and the
+// function fails because the connection is broken (i.e. the server dropped it), it
+// is called again with a new connection. It must be false if the function is not
+// safe to call again after it may have been partially applied.
+func (this *RedisStore) withConn(retry bool, fn func(redis.Conn) error) error {
+	var err error
+	for i := 0; i < 2; i++ {
+		conn := this.pool.Get()
+		err = fn(conn)
+		broken := conn.Err() != nil
+		conn.Close()
+		if err == nil || !broken || !retry {
+			break
+		}
+	}
+	return err
 }
 
-func (this *RedisStore) getSessionKeys() ([]interface{}, error) {
+// Get the Redis key of the session ID, using the key prefix if specified.
+func (this *RedisStore) getKey(id string) string {
 	if this.opts.KeyPrefix != "" {
-		return redis.Values(this.conn.Do("KEYS", this.opts.KeyPrefix+":*"))
+		return this.opts.KeyPrefix + ":" + id
 	}
-	return nil, ErrNoKeyPrefix
+	return id
 }
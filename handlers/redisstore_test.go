@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/ghost/handlers/internal/redisstub"
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestRedisStoreDialError(t *testing.T) {
+	// Get a free address, with no server listening
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	rs, err := NewRedisStore(&RedisStoreOptions{
+		Network:        "tcp",
+		Address:        addr,
+		ConnectTimeout: time.Second,
+	})
+	assertTrue(err != nil, "expected error connecting to the server, got nil", t)
+	assertTrue(rs == nil, "expected store to be nil", t)
+}
+
+func TestRedisStoreContextTimeout(t *testing.T) {
+	srv, err := redisstub.NewServer()
+	if err != nil {
+		panic(err)
+	}
+	defer srv.Close()
+	rs, err := NewRedisStore(&RedisStoreOptions{Network: "tcp", Address: srv.Addr()})
+	if err != nil {
+		panic(err)
+	}
+	defer rs.Close()
+
+	srv.SetDelay(500 * time.Millisecond)
+	ssn := newSession(0)
+	calls := map[string]func(ctx context.Context) error{
+		"get": func(ctx context.Context) error {
+			_, err := rs.GetContext(ctx, "id")
+			return err
+		},
+		"compare and set": func(ctx context.Context) error {
+			_, err := rs.CompareAndSetContext(ctx, ssn, 0)
+			return err
+		},
+		"replace": func(ctx context.Context) error {
+			_, err := rs.ReplaceContext(ctx, ssn, ssn.ID())
+			return err
+		},
+		"touch": func(ctx context.Context) error {
+			return rs.TouchContext(ctx, ssn)
+		},
+	}
+	for k, fn := range calls {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		start := time.Now()
+		err = fn(ctx)
+		cancel()
+		assertTrue(err == context.DeadlineExceeded, fmt.Sprintf("%s: expected deadline exceeded, got %v", k, err), t)
+		assertTrue(time.Since(start) < 250*time.Millisecond, fmt.Sprintf("%s: expected the call to be abandoned, took %s", k, time.Since(start)), t)
+	}
+}
+
+func TestRedisStoreClearBatches(t *testing.T) {
+	srv, err := redisstub.NewServer()
+	if err != nil {
+		panic(err)
+	}
+	defer srv.Close()
+	rs, err := NewRedisStore(&RedisStoreOptions{Network: "tcp", Address: srv.Addr(), KeyPrefix: "sess", ScanCount: 3})
+	if err != nil {
+		panic(err)
+	}
+	defer rs.Close()
+
+	for i := 0; i < 10; i++ {
+		ssn := newSession(0)
+		if err := rs.Set(ssn); err != nil {
+			panic(err)
+		}
+		if err := rs.Associate("user", ssn.ID()); err != nil {
+			panic(err)
+		}
+	}
+	assertTrue(rs.Len() == 10, fmt.Sprintf("expected 10 sessions, got %d", rs.Len()), t)
+	if err := rs.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	assertTrue(rs.Len() == 0, fmt.Sprintf("expected no session, got %d", rs.Len()), t)
+	keys := srv.Keys(0)
+	assertTrue(len(keys) == 0, fmt.Sprintf("expected no keys left, got %v", keys), t)
+}
+
+func TestRedisStorePruneIndex(t *testing.T) {
+	srv, err := redisstub.NewServer()
+	if err != nil {
+		panic(err)
+	}
+	defer srv.Close()
+	rs, err := NewRedisStore(&RedisStoreOptions{Network: "tcp", Address: srv.Addr(), KeyPrefix: "sess"})
+	if err != nil {
+		panic(err)
+	}
+	defer rs.Close()
+	conn, err := redis.Dial("tcp", srv.Addr())
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+
+	// Add expired IDs to the index, as if their sessions expired
+	exp := time.Now().Add(-time.Hour).Unix()
+	for i := 0; i < redisIndexPruneCount+5; i++ {
+		if _, err := conn.Do("ZADD", "sess:"+redisIndexKeySuffix, exp+int64(i), fmt.Sprintf("expired%d", i)); err != nil {
+			panic(err)
+		}
+	}
+	assertTrue(rs.Len() == 0, fmt.Sprintf("expected expired IDs not to be counted, got %d", rs.Len()), t)
+
+	// Each write removes a bounded batch of expired IDs
+	for i, want := range []int{6, 2} {
+		if err := rs.Set(newSession(0)); err != nil {
+			panic(err)
+		}
+		n, err := redis.Int(conn.Do("ZCARD", "sess:"+redisIndexKeySuffix))
+		if err != nil {
+			panic(err)
+		}
+		assertTrue(n == want, fmt.Sprintf("write %d: expected %d IDs in the index, got %d", i, want, n), t)
+	}
+	assertTrue(rs.Len() == 2, fmt.Sprintf("expected 2 sessions, got %d", rs.Len()), t)
+}
+
+func TestRedisStoreBrokenConn(t *testing.T) {
+	srv, err := redisstub.NewServer()
+	if err != nil {
+		panic(err)
+	}
+	defer srv.Close()
+	rs, err := NewRedisStore(&RedisStoreOptions{Network: "tcp", Address: srv.Addr()})
+	if err != nil {
+		panic(err)
+	}
+	defer rs.Close()
+
+	ssn := newSession(0)
+	if err := rs.Set(ssn); err != nil {
+		panic(err)
+	}
+	// The idle connection is not checked, the call is retried with a new connection
+	srv.DropConns()
+	got, err := rs.Get(ssn.ID())
+	assertTrue(err == nil, fmt.Sprintf("expected no error, got %v", err), t)
+	assertTrue(got != nil, "expected the session to be found", t)
+
+	// Compare and set is not retried, it may have been applied
+	srv.DropConns()
+	_, err = rs.CompareAndSet(ssn, ssn.Version())
+	assertTrue(err != nil, "expected an error on the broken connection, got nil", t)
+	ok, err := rs.CompareAndSet(ssn, ssn.Version())
+	assertTrue(err == nil && ok, fmt.Sprintf("expected compare and set to succeed, got %t, %v", ok, err), t)
+}
+
+func TestRedisStoreOwnerCleanup(t *testing.T) {
+	srv, err := redisstub.NewServer()
+	if err != nil {
+		panic(err)
+	}
+	defer srv.Close()
+	rs, err := NewRedisStore(&RedisStoreOptions{Network: "tcp", Address: srv.Addr(), KeyPrefix: "sess"})
+	if err != nil {
+		panic(err)
+	}
+	defer rs.Close()
+	conn, err := redis.Dial("tcp", srv.Addr())
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+	members := func() []string {
+		ids, err := redis.Strings(conn.Do("SMEMBERS", "sess:_owner:me"))
+		if err != nil {
+			panic(err)
+		}
+		return ids
+	}
+
+	// Associated before it is saved, for the grace period
+	s1, s2, s3 := newSession(3600), newSession(0), newSession(0)
+	rs.Associate("me", s1.ID())
+	ttl, _ := redis.Int(conn.Do("TTL", "sess:_sessowner:"+s1.ID()))
+	assertTrue(ttl > 0 && ttl <= int(redisOwnerGracePeriod.Seconds()), fmt.Sprintf("expected the grace period, got %d", ttl), t)
+
+	// Saved, the association and the set expire with the session
+	rs.Set(s1)
+	ttl, _ = redis.Int(conn.Do("TTL", "sess:_sessowner:"+s1.ID()))
+	assertTrue(ttl > 3000, fmt.Sprintf("expected the TTL of the session, got %d", ttl), t)
+	ttl, _ = redis.Int(conn.Do("TTL", "sess:_owner:me"))
+	assertTrue(ttl > 3000, fmt.Sprintf("expected the TTL of the session for the set, got %d", ttl), t)
+
+	// Removed on delete and on move
+	rs.Set(s2)
+	rs.Associate("me", s2.ID())
+	rs.Delete(s1.ID())
+	old := s2.ID()
+	s2.Regenerate()
+	if ok, err := rs.Replace(s2, old); !ok || err != nil {
+		t.Fatalf("expected session to be moved, got %t, %v", ok, err)
+	}
+	ids := members()
+	assertTrue(len(ids) == 0, fmt.Sprintf("expected no session IDs in the set, got %v", ids), t)
+
+	// Pruned by OwnerSessions once the association expired
+	rs.Associate("me", s3.ID())
+	conn.Do("DEL", "sess:_sessowner:"+s3.ID())
+	got, err := rs.OwnerSessions("me")
+	assertTrue(err == nil && len(got) == 0, fmt.Sprintf("expected no sessions, got %v, %v", got, err), t)
+	ids = members()
+	assertTrue(len(ids) == 0, fmt.Sprintf("expected the stale ID to be pruned, got %v", ids), t)
+	keys := srv.Keys(0)
+	assertTrue(len(keys) == 2, fmt.Sprintf("expected only the session and the index, got %v", keys), t)
+}
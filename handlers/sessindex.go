@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+)
+
+var (
+	ErrNoSession               = errors.New("no session for the current request")
+	ErrNoUser                  = errors.New("no authenticated user for the current request")
+	ErrSessionIndexUnsupported = errors.New("session store does not index sessions by owner")
+)
+
+// Associate the session of the current request with the user authenticated for the
+// current request (see GetUserName), so that all sessions of the user can be listed
+// and deleted. It must be called after the authentication, and after the session ID
+// is regenerated, if it is. The session store must implement SessionIndexer.
+func IndexUserSession(w http.ResponseWriter) error {
+	ss, ok := getSessionWriter(w)
+	if !ok {
+		return ErrNoSession
+	}
+	user, ok := GetUserName(w)
+	if !ok || user == "" {
+		return ErrNoUser
+	}
+	idx, ok := ss.sessStore.(SessionIndexer)
+	if !ok {
+		return ErrSessionIndexUnsupported
+	}
+	return idx.Associate(user, ss.sess.ID())
+}
+
+// Get the IDs of the sessions of the user in the session store.
+func GetUserSessions(w http.ResponseWriter, user string) ([]string, error) {
+	ss, ok := getSessionWriter(w)
+	if !ok {
+		return nil, ErrNoSession
+	}
+	idx, ok := ss.sessStore.(SessionIndexer)
+	if !ok {
+		return nil, ErrSessionIndexUnsupported
+	}
+	return idx.OwnerSessions(user)
+}
+
+// Delete all sessions of the user from the session store (log out everywhere). If
+// the session of the current request is associated with the user (under its current
+// or its old ID, if it was regenerated), it is destroyed, so that it is not saved
+// again at the end of the request.
+func DeleteUserSessions(w http.ResponseWriter, user string) error {
+	ss, ok := getSessionWriter(w)
+	if !ok {
+		return ErrNoSession
+	}
+	idx, ok := ss.sessStore.(SessionIndexer)
+	if !ok {
+		return ErrSessionIndexUnsupported
+	}
+	// The session may not be saved yet, so it is not listed by OwnerSessions
+	for _, id := range []string{ss.sess.ID(), ss.sess.oldID} {
+		if id == "" {
+			continue
+		}
+		own, err := idx.IsOwner(user, id)
+		if err != nil {
+			return err
+		}
+		if own {
+			// If the cookie is already sent, the session is still deleted
+			ss.sess.Destroy()
+			break
+		}
+	}
+	return idx.DeleteOwnerSessions(user)
+}
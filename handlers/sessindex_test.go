@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMemoryStoreIndex(t *testing.T) {
+	ms := NewMemoryStore(1)
+	defer ms.Close()
+
+	s1, s2, s3 := newSession(0), newSession(0), newSession(0)
+	for _, s := range []*Session{s1, s2, s3} {
+		ms.Set(s)
+	}
+	ms.Associate("me", s1.ID())
+	ms.Associate("me", s2.ID())
+	ms.Associate("you", s3.ID())
+	ids, _ := ms.OwnerSessions("me")
+	assertTrue(len(ids) == 2, fmt.Sprintf("expected 2 sessions, got %d", len(ids)), t)
+
+	// A deleted session is removed from the index
+	ms.Delete(s2.ID())
+	ids, _ = ms.OwnerSessions("me")
+	assertTrue(len(ids) == 1 && ids[0] == s1.ID(), fmt.Sprintf("expected session 1, got %v", ids), t)
+
+	ms.DeleteOwnerSessions("me")
+	ids, _ = ms.OwnerSessions("me")
+	assertTrue(len(ids) == 0, fmt.Sprintf("expected no session, got %d", len(ids)), t)
+	assertTrue(ms.Len() == 1, fmt.Sprintf("expected 1 session in the store, got %d", ms.Len()), t)
+	ids, _ = ms.OwnerSessions("you")
+	assertTrue(len(ids) == 1 && ids[0] == s3.ID(), fmt.Sprintf("expected session 3, got %v", ids), t)
+}
+
+// Send an authenticated request with the specified cookie, return the response
+// and its body.
+func doAuthRequestWithCookie(u string, ck *http.Cookie) (*http.Response, string) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		panic(err)
+	}
+	req.SetBasicAuth("me", "pwd")
+	if ck != nil {
+		req.AddCookie(ck)
+	}
+	res, err := new(http.Client).Do(req)
+	if err != nil {
+		panic(err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		panic(err)
+	}
+	return res, string(b)
+}
+
+func TestDeleteUserSessions(t *testing.T) {
+	ms := NewMemoryStore(1)
+	defer ms.Close()
+	h := BasicAuthHandler(SessionHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ssn, _ := GetSession(w)
+		switch r.URL.Path {
+		case "/login":
+			if err := IndexUserSession(w); err != nil {
+				panic(err)
+			}
+		case "/logout-all":
+			if err := DeleteUserSessions(w, "me"); err != nil {
+				panic(err)
+			}
+		case "/login-logout-all":
+			// The new session is not saved yet
+			if err := IndexUserSession(w); err != nil {
+				panic(err)
+			}
+			if err := DeleteUserSessions(w, "me"); err != nil {
+				panic(err)
+			}
+		case "/count":
+			ids, err := GetUserSessions(w, "me")
+			if err != nil {
+				panic(err)
+			}
+			fmt.Fprint(w, len(ids))
+			return
+		}
+		w.Write([]byte(ssn.ID()))
+	}), NewSessionOptions(ms, secret)), func(u, pwd string) (interface{}, bool) {
+		return u, true
+	}, "")
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	// Log in from two clients
+	res, id1 := doAuthRequestWithCookie(s.URL+"/login", nil)
+	ck1 := res.Cookies()[0]
+	res, id2 := doAuthRequestWithCookie(s.URL+"/login", nil)
+	ck2 := res.Cookies()[0]
+	_, cnt := doAuthRequestWithCookie(s.URL+"/count", ck1)
+	assertTrue(cnt == "2", fmt.Sprintf("expected 2 sessions, got %s", cnt), t)
+
+	// Log out everywhere from the first client, its cookie is expired
+	res, _ = doAuthRequestWithCookie(s.URL+"/logout-all", ck1)
+	if assertTrue(len(res.Cookies()) == 1, fmt.Sprintf("expected 1 cookie, got %d", len(res.Cookies())), t) {
+		assertTrue(res.Cookies()[0].MaxAge < 0, "expected cookie to be expired", t)
+	}
+	assertTrue(ms.Len() == 0, fmt.Sprintf("expected no session in the store, got %d", ms.Len()), t)
+
+	// The second client gets a new session
+	_, id3 := doAuthRequestWithCookie(s.URL, ck2)
+	assertTrue(id3 != id2 && id3 != id1, "expected a new session ID, got an old one", t)
+
+	// A session associated and deleted in the same request is not saved
+	n := ms.Len()
+	res, _ = doAuthRequestWithCookie(s.URL+"/login-logout-all", nil)
+	for _, ck := range res.Cookies() {
+		assertTrue(ck.MaxAge < 0, "expected cookie to be expired", t)
+	}
+	assertTrue(ms.Len() == n, fmt.Sprintf("expected %d sessions in the store, got %d", n, ms.Len()), t)
+}
@@ -1,10 +1,15 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"hash/crc32"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 
@@ -13,18 +18,36 @@ import (
 	"github.com/nu7hatch/gouuid"
 )
 
-const defaultCookieName = "ghost.sid"
+const (
+	defaultCookieName  = "ghost.sid"
+	defaultTokenHeader = "X-Session-Token"
+)
 
 var (
 	ErrSessionSecretMissing = errors.New("session secret is missing")
+	ErrInvalidEncryptionKey = errors.New("session encryption key must be 16, 24 or 32 bytes long")
 	ErrNoSessionID          = errors.New("session ID could not be generated")
+	ErrSessionConflict      = errors.New("session was modified by a concurrent request")
+	ErrSessionGone          = errors.New("session is no longer in the store")
+	ErrMergeMissing         = errors.New("session merge function is missing")
+	ErrInvalidTransport     = errors.New("session transport is invalid")
+	ErrInvalidCookie        = errors.New("session cookie template is invalid")
+	ErrNoSessionToken       = errors.New("session token not present")
+	ErrSessionSent          = errors.New("session cookie or token was already sent")
 )
 
 // The Session holds the data map that persists for the duration of the session.
 // The information stored in this map should be marshalable for the target Session store
 // format (i.e. json, sql, gob, etc. depending on how the store persists the data).
+// The session is saved when it is modified via Set, Delete, Clear or MarkModified
+// (or directly via Data when SessionOptions.HashModified is set).
 type Session struct {
-	isNew bool // keep private, not saved to JSON, will be false once read from the store
+	isNew     bool   // keep private, not saved to JSON, will be false once read from the store
+	oldID     string // ID of the session in the store, if the ID was regenerated during the request
+	destroyed bool   // the session must be deleted from the store at the end of the request
+	modified  bool   // the data was modified via the accessors during the request
+	// Reports if the cookie or token is sent, set by the SessionHandler
+	sent func() bool
 	internalSession
 }
 
@@ -32,10 +55,12 @@ type Session struct {
 // although those fields are exposed (public). This is a trick to simplify
 // JSON encoding.
 type internalSession struct {
-	Data    map[string]interface{} // JSON cannot marshal a map[interface{}]interface{}
-	ID      string
-	Created time.Time
-	MaxAge  time.Duration
+	Data       map[string]interface{} // JSON cannot marshal a map[interface{}]interface{}
+	ID         string
+	Created    time.Time
+	MaxAge     time.Duration
+	Version    int64     // Incremented each time the session is saved, for optimistic concurrency
+	LastAccess time.Time // Time of the last request on the session
 }
 
 // Create a new Session instance. It panics in the unlikely event that a new random ID cannot be generated.
@@ -44,17 +69,27 @@ func newSession(maxAge int) *Session {
 	if err != nil {
 		panic(ErrNoSessionID)
 	}
+	now := time.Now()
 	return &Session{
-		true, // is new
-		internalSession{
+		isNew: true,
+		internalSession: internalSession{
 			make(map[string]interface{}),
 			uid.String(),
-			time.Now(),
+			now,
 			time.Duration(maxAge) * time.Second,
+			0,
+			now,
 		},
 	}
 }
 
+// Create a new Session with the specified max age in seconds (0 means a browser session).
+// Sessions are created by the SessionHandler, this is for use outside of a request (i.e.
+// to test a store).
+func NewSession(maxAge int) *Session {
+	return newSession(maxAge)
+}
+
 // Gets the ID of the session.
 func (ø *Session) ID() string {
 	return ø.internalSession.ID
@@ -70,13 +105,129 @@ func (ø *Session) Created() time.Time {
 	return ø.internalSession.Created
 }
 
+// Get the version of the session, that is the number of times it was saved.
+func (ø *Session) Version() int64 {
+	return ø.internalSession.Version
+}
+
+// Get the time of the last request on the session. It is saved with the session
+// only when it is modified, unless SessionOptions.IdleTimeout is set.
+func (ø *Session) LastAccess() time.Time {
+	if ø.internalSession.LastAccess.IsZero() {
+		// Saved before the last access was tracked
+		return ø.internalSession.Created
+	}
+	return ø.internalSession.LastAccess
+}
+
+// Is the session expired at the specified time because it was idle for longer
+// than the idle timeout, or created for longer than the absolute timeout (0 means
+// no limit).
+func (ø *Session) timedOut(now time.Time, idle, absolute time.Duration) bool {
+	return (idle > 0 && now.Sub(ø.LastAccess()) > idle) ||
+		(absolute > 0 && now.Sub(ø.Created()) > absolute)
+}
+
 // Is this a new Session (created by the current request)
 func (ø *Session) IsNew() bool {
 	return ø.isNew
 }
 
-// TODO : Resets the max age property of the session to its original value (sliding expiration).
-func (ø *Session) resetMaxAge() {
+// Get the value of the key in the session data.
+func (ø *Session) Get(key string) interface{} {
+	return ø.Data[key]
+}
+
+// Set the value of the key in the session data, and mark the session as modified.
+func (ø *Session) Set(key string, val interface{}) {
+	if ø.Data == nil {
+		ø.Data = make(map[string]interface{})
+	}
+	ø.Data[key] = val
+	ø.modified = true
+}
+
+// Delete the key from the session data, and mark the session as modified if the
+// key existed.
+func (ø *Session) Delete(key string) {
+	if _, ok := ø.Data[key]; ok {
+		delete(ø.Data, key)
+		ø.modified = true
+	}
+}
+
+// Clear all keys from the session data, and mark the session as modified.
+func (ø *Session) Clear() {
+	ø.Data = make(map[string]interface{})
+	ø.modified = true
+}
+
+// MarkModified marks the session as modified, so that it is saved at the end of
+// the request. It must be called when the data is changed in place (i.e. a value
+// of the data map is mutated) or directly via Data, unless SessionOptions.HashModified
+// is set.
+func (ø *Session) MarkModified() {
+	ø.modified = true
+}
+
+// Is the session data modified via the accessors during the current request.
+func (ø *Session) IsModified() bool {
+	return ø.modified
+}
+
+// Regenerate issues a new ID for the session, keeping its data. At the end of the
+// request, the session is moved to the new ID in the store and the old ID is deleted.
+// It must be called before the response is written, so that the cookie with the
+// new ID can be sent, typically right after a login to prevent session fixation.
+// Otherwise the ID is not changed and ErrSessionSent is returned.
+func (ø *Session) Regenerate() error {
+	if ø.isSent() {
+		return ErrSessionSent
+	}
+	uid, err := uuid.NewV4()
+	if err != nil {
+		return ErrNoSessionID
+	}
+	if !ø.isNew && ø.oldID == "" {
+		// Keep the ID that is saved in the store, if regenerated more than once
+		ø.oldID = ø.internalSession.ID
+	}
+	ø.internalSession.ID = uid.String()
+	return nil
+}
+
+// Destroy ends the session. At the end of the request, the session is deleted from
+// the store instead of being saved, and the session cookie is expired. It should be
+// called before the response is written, so that the expired cookie can be sent.
+// Otherwise the session is still deleted from the store, but ErrSessionSent is
+// returned since the client keeps its cookie.
+func (ø *Session) Destroy() error {
+	ø.destroyed = true
+	if ø.isSent() {
+		return ErrSessionSent
+	}
+	return nil
+}
+
+// Is the session destroyed by the current request.
+func (ø *Session) IsDestroyed() bool {
+	return ø.destroyed
+}
+
+// Is the session cookie or token already sent for the current request.
+func (ø *Session) isSent() bool {
+	return ø.sent != nil && ø.sent()
+}
+
+// Is the session ID regenerated by the current request.
+func (ø *Session) isRegenerated() bool {
+	return ø.oldID != ""
+}
+
+// Resets the max age property of the session to the specified value in seconds
+// (sliding expiration).
+func (ø *Session) resetMaxAge(maxAge int) {
+	ø.internalSession.MaxAge = time.Duration(maxAge) * time.Second
 }
 
 // Marshal the session to JSON.
@@ -89,17 +240,138 @@ func (ø *Session) UnmarshalJSON(b []byte) error {
 	return json.Unmarshal(b, &ø.internalSession)
 }
 
+// The gob representation of the session. The data map is saved as sorted keys and
+// values, so that the encoding is deterministic (gob encodes maps in random order).
+// Only the data map itself is sorted, not the maps in its values.
+type gobSession struct {
+	Keys       []string
+	Values     []interface{}
+	ID         string
+	Created    time.Time
+	MaxAge     time.Duration
+	Version    int64
+	LastAccess time.Time
+}
+
+// Encode the session to gob. The types of the values in the data map must be
+// registered with gob.Register.
+func (ø *Session) GobEncode() ([]byte, error) {
+	gs := gobSession{
+		Keys:       make([]string, 0, len(ø.Data)),
+		Values:     make([]interface{}, 0, len(ø.Data)),
+		ID:         ø.internalSession.ID,
+		Created:    ø.internalSession.Created,
+		MaxAge:     ø.internalSession.MaxAge,
+		Version:    ø.internalSession.Version,
+		LastAccess: ø.internalSession.LastAccess,
+	}
+	for k := range ø.Data {
+		gs.Keys = append(gs.Keys, k)
+	}
+	sort.Strings(gs.Keys)
+	for _, k := range gs.Keys {
+		gs.Values = append(gs.Values, ø.Data[k])
+	}
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(gs)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode the gob-encoded session into the internal session struct.
+func (ø *Session) GobDecode(b []byte) error {
+	var gs gobSession
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&gs)
+	if err != nil {
+		return err
+	}
+	ø.Data = make(map[string]interface{}, len(gs.Keys))
+	for i, k := range gs.Keys {
+		ø.Data[k] = gs.Values[i]
+	}
+	ø.internalSession.ID = gs.ID
+	ø.internalSession.Created = gs.Created
+	ø.internalSession.MaxAge = gs.MaxAge
+	ø.internalSession.Version = gs.Version
+	ø.internalSession.LastAccess = gs.LastAccess
+	return nil
+}
+
+// Get a copy of the saved fields of the session, with its own data map (the values
+// are not copied). The state of the current request (regenerated, destroyed or
+// modified) is not copied.
+func (ø *Session) clone() *Session {
+	c := &Session{isNew: ø.isNew, internalSession: ø.internalSession}
+	c.Data = make(map[string]interface{}, len(ø.Data))
+	for k, v := range ø.Data {
+		c.Data[k] = v
+	}
+	return c
+}
+
 // Options object for the session handler. It specified the Session store to use for
 // persistence, the template for the session cookie (name, path, maxage, etc.),
 // whether or not the proxy should be trusted to determine if the connection is secure,
-// and the required secret to sign the session cookie.
+// and the secret to sign the session cookie (required, unless the store implements
+// SessionCookieWriter and authenticates the cookie itself). The session is saved when it
+// is modified, and sent back with the transport it was received from (a new session
+// is sent with all the Transports). If OnError returns true when the session cannot
+// be loaded, the request is considered handled (e.g. it responded with a 503) and the
+// wrapped handler is not called. Its return value is ignored for the errors that
+// occur when sending, saving or deleting the session. The errors of the save and
+// delete are reported after the wrapped handler returned, use IsResponseCommitted
+// to check if the response can still be changed (i.e. to respond with a 500).
 type SessionOptions struct {
-	Store          SessionStore
-	CookieTemplate http.Cookie
-	TrustProxy     bool
-	Secret         string
+	Store             SessionStore
+	CookieTemplate    http.Cookie // Validated by SessionHandler, for the SameSite mode and the __Secure- and __Host- name prefixes
+	TrustProxy        bool
+	Secret            string
+	Secrets           []string     // Previous secrets, to verify the cookies and sign them again with Secret (or the first one if Secret is empty)
+	EncryptionKey     []byte       // If set (AES-128, AES-192 or AES-256), the cookie value is also encrypted
+	AllowUnencrypted  bool         // Accept (and send again encrypted) the cookies that are only signed, to migrate them
+	SlidingExpiration bool         // Send the cookie again and refresh the session in the store on each request
+	Codec             SessionCodec // Encoding used by HashModified, defaults to JSONCodec (see GobCodec for the maps in Data values)
+	HashModified      bool         // Also detect the changes made directly to Data, by hashing the encoded session before and after the request
+	// Called with the errors of the store and of the session cookie
+	OnError         func(w http.ResponseWriter, r *http.Request, err error) bool
+	ConflictPolicy  ConflictPolicy     // Applied if the store implements SessionCompareAndSetter, defaults to ConflictLastWriteWins
+	Merge           MergeFunc          // Required by ConflictMerge
+	IdleTimeout     time.Duration      // Expire the session if not accessed for this duration (its last access time is saved on each request)
+	AbsoluteTimeout time.Duration      // Expire the session if created for longer than this duration
+	Transports      []SessionTransport // Where the session ID is read from, in order of preference, defaults to the cookie
+	TokenHeader     string             // Header of TransportHeader, defaults to X-Session-Token
 }
 
+// The transport of the session ID between the client and the server.
+type SessionTransport int
+
+const (
+	TransportCookie SessionTransport = iota // The session cookie
+	TransportHeader                         // The TokenHeader header
+	TransportBearer                         // The Authorization header, as a bearer token
+)
+
+// The policy to apply when a session was saved by a concurrent request.
+type ConflictPolicy int
+
+const (
+	ConflictLastWriteWins ConflictPolicy = iota // Save the session anyway
+	ConflictFail                                // Do not save the session, report ErrSessionConflict
+	ConflictMerge                               // Merge with the stored session and try again
+)
+
+// Number of times the session is merged and saved again with ConflictMerge, before
+// ErrSessionConflict is reported.
+const maxMergeRetries = 3
+
+// MergeFunc merges the changes of the stored session into the session of the
+// current request, which is then saved. The session of the request keeps its own
+// version, it is replaced by the handler. If an error is returned, the session is
+// not saved.
+type MergeFunc func(sess, stored *Session) error
+
 // Create a new SessionOptions struct, using default cookie and proxy values.
 func NewSessionOptions(store SessionStore, secret string) *SessionOptions {
 	return &SessionOptions{
@@ -158,10 +430,35 @@ func SessionHandler(h http.Handler, opts *SessionOptions) http.HandlerFunc {
 	if opts.CookieTemplate.Path == "" {
 		opts.CookieTemplate.Path = "/"
 	}
-	// Secret is required
-	if opts.Secret == "" {
+	if err := validateCookieTemplate(&opts.CookieTemplate); err != nil {
+		panic(err)
+	}
+	// Secret is required, unless the session is saved in the cookie by the store
+	cw, isCookieStore := opts.Store.(SessionCookieWriter)
+	scks := newSecureCookies(opts)
+	if len(scks) == 0 && !isCookieStore {
 		panic(ErrSessionSecretMissing)
 	}
+	// Encryption key is optional, but must be valid
+	switch len(opts.EncryptionKey) {
+	case 0, 16, 24, 32:
+	default:
+		panic(ErrInvalidEncryptionKey)
+	}
+	if opts.ConflictPolicy == ConflictMerge && opts.Merge == nil {
+		panic(ErrMergeMissing)
+	}
+	if len(opts.Transports) == 0 {
+		opts.Transports = []SessionTransport{TransportCookie}
+	}
+	for _, t := range opts.Transports {
+		if t < TransportCookie || t > TransportBearer {
+			panic(ErrInvalidTransport)
+		}
+	}
+	if opts.TokenHeader == "" {
+		opts.TokenHeader = defaultTokenHeader
+	}
 
 	// Return the actual handler
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -178,15 +475,26 @@ func SessionHandler(h http.Handler, opts *SessionOptions) http.HandlerFunc {
 		}
 
 		// Create a new Session or retrieve the existing session based on the
-		// session cookie received.
+		// session token received, via the cookie or a header.
 		var sess *Session
 		var ckSessId string
-		exCk, err := r.Cookie(opts.CookieTemplate.Name)
+		var resign bool
+		exCk, trsp, err := getSessionToken(r, opts)
 		if err != nil {
 			sess = newSession(opts.CookieTemplate.MaxAge)
-			ghost.LogFn("ghost.session : error getting session cookie : %s", err)
+			ghost.LogFn("ghost.session : error getting session token : %s", err)
+		} else if isCookieStore {
+			// The session is saved in the cookie
+			sess, err = cw.ReadCookie(exCk.Name, exCk.Value)
+			if err != nil {
+				sess = newSession(opts.CookieTemplate.MaxAge)
+				ghost.LogFn("ghost.session : error reading session from cookie : %s", err)
+			} else if sess == nil {
+				sess = newSession(opts.CookieTemplate.MaxAge)
+				ghost.LogFn("ghost.session : nil session")
+			}
 		} else {
-			ckSessId, err = parseSignedCookie(exCk, opts.Secret)
+			ckSessId, resign, err = parseSignedCookie(exCk, scks)
 			if err != nil {
 				sess = newSession(opts.CookieTemplate.MaxAge)
 				ghost.LogFn("ghost.session : error parsing signed cookie : %s", err)
@@ -195,68 +503,319 @@ func SessionHandler(h http.Handler, opts *SessionOptions) http.HandlerFunc {
 				ghost.LogFn("ghost.session : no existing session ID")
 			} else {
 				// Get the session
-				sess, err = opts.Store.Get(ckSessId)
+				sess, err = getSession(r.Context(), opts.Store, ckSessId)
 				if err != nil {
-					sess = newSession(opts.CookieTemplate.MaxAge)
 					ghost.LogFn("ghost.session : error getting session from store : %s", err)
+					if opts.OnError != nil && opts.OnError(w, r, err) {
+						return
+					}
+					sess = newSession(opts.CookieTemplate.MaxAge)
 				} else if sess == nil {
 					sess = newSession(opts.CookieTemplate.MaxAge)
 					ghost.LogFn("ghost.session : nil session")
 				}
 			}
 		}
-		// Save the original hash of the session, used to compare if the contents
-		// have changed during the handling of the request, so that it has to be
-		// saved to the stored.
-		oriHash := hash(sess)
+		// Enforce the idle and absolute timeouts of an existing session
+		now := time.Now()
+		if !sess.IsNew() && sess.timedOut(now, opts.IdleTimeout, opts.AbsoluteTimeout) {
+			ghost.LogFn("ghost.session : session timed out")
+			if !isCookieStore {
+				if err := deleteSession(r.Context(), opts.Store, sess.ID()); err != nil {
+					ghost.LogFn("ghost.session : error deleting session from store : %s", err)
+				}
+			}
+			sess = newSession(opts.CookieTemplate.MaxAge)
+		}
+		sess.internalSession.LastAccess = now
+		// The modified flag is only for the current request, in case a custom store
+		// returns the same instance between requests.
+		sess.modified = false
+		version := sess.Version()
+		// If the changes made directly to Data are detected, save the original hash of
+		// the session, used to compare if the contents have changed during the handling
+		// of the request, so that it has to be saved to the store. A new session is
+		// always saved.
+		codec := getCodec(opts.Codec)
+		hashed := opts.HashModified && !sess.IsNew()
+		var oriHash uint32
+		if hashed {
+			oriHash = hash(codec, sess)
+		}
+		modified := func() bool {
+			return sess.IsModified() || (hashed && isModified(codec, sess, oriHash))
+		}
 
 		// Create the augmented ResponseWriter.
 		srw := &sessResponseWriter{w, sess, opts.Store, false, func() {
 			// This function is called when the header is about to be written, so that
-			// the session cookie is correctly set.
+			// the session cookie (or header) is correctly set.
+
+			// Send the session with the transport it was received from, or with all
+			// transports if it is a new session.
+			var sendCk, sendHdr bool
+			if exCk == nil {
+				for _, t := range opts.Transports {
+					sendCk = sendCk || t == TransportCookie
+					sendHdr = sendHdr || t != TransportCookie
+				}
+			} else {
+				sendCk, sendHdr = trsp == TransportCookie, trsp != TransportCookie
+			}
 
 			// Check if the connection is secure
 			proto := strings.Trim(strings.ToLower(r.Header.Get("X-Forwarded-Proto")), " ")
 			tls := r.TLS != nil || (strings.HasPrefix(proto, "https") && opts.TrustProxy)
-			if opts.CookieTemplate.Secure && !tls {
+			if sendCk && opts.CookieTemplate.Secure && !tls {
 				ghost.LogFn("ghost.session : secure cookie on a non-secure connection, cookie not sent")
+				sendCk = false
+			}
+			if sess.IsDestroyed() {
+				if sendCk {
+					// Expire the session cookie
+					ck := opts.CookieTemplate
+					ck.Value = ""
+					ck.MaxAge = -1
+					ck.Expires = time.Unix(1, 0)
+					http.SetCookie(w, &ck)
+				}
+				if sendHdr {
+					// An empty token tells the client to drop its token
+					w.Header().Set(opts.TokenHeader, "")
+				}
 				return
 			}
-			if !sess.IsNew() {
-				// If this is not a new session, no need to send back the cookie
-				// TODO : Handle expires?
+			if !sendCk && !sendHdr {
+				return
+			}
+			if !sess.IsNew() && !sess.isRegenerated() && !opts.SlidingExpiration && !resign &&
+				!(isCookieStore && (modified() || opts.IdleTimeout > 0)) {
+				// If this is not a new session, no need to send back the cookie,
+				// unless the ID changed, the expiration must be pushed back, the
+				// cookie was signed with an old secret (or the cookie holds the
+				// modified session).
 				return
 			}
 
-			// Send the session cookie
+			// Send the session cookie or token
 			ck := opts.CookieTemplate
-			ck.Value = sess.ID()
-			err := signCookie(&ck, opts.Secret)
-			if err != nil {
-				ghost.LogFn("ghost.session : error signing cookie : %s", err)
-				return
+			if isCookieStore {
+				val, err := cw.WriteCookie(ck.Name, sess)
+				if err != nil {
+					ghost.LogFn("ghost.session : error writing session to cookie : %s", err)
+					if opts.OnError != nil {
+						opts.OnError(w, r, err)
+					}
+					return
+				}
+				ck.Value = val
+			} else {
+				ck.Value = sess.ID()
+				err := signCookie(&ck, scks[0])
+				if err != nil {
+					ghost.LogFn("ghost.session : error signing cookie : %s", err)
+					if opts.OnError != nil {
+						opts.OnError(w, r, err)
+					}
+					return
+				}
+			}
+			if sendCk {
+				http.SetCookie(w, &ck)
+			}
+			if sendHdr {
+				w.Header().Set(opts.TokenHeader, ck.Value)
 			}
-			http.SetCookie(w, &ck)
 		}}
+		sess.sent = func() bool {
+			return srw.sessSent
+		}
 
 		// Call wrapped handler
 		h.ServeHTTP(srw, r)
 
-		// TODO : Expiration management? srw.sess.resetMaxAge()
-		// Do not save if content is the same, unless session is new (to avoid
-		// creating a new session and sending a cookie on each successive request).
-		if newHash := hash(sess); !sess.IsNew() && oriHash == newHash && newHash != 0 {
-			// No changes to the session, no need to save
-			ghost.LogFn("ghost.session : no changes to save to store")
-			return
+		ctx := r.Context()
+		if sess.IsDestroyed() {
+			// Delete the session from the store, do not save it
+			err = destroySession(ctx, opts.Store, sess)
+		} else {
+			if opts.SlidingExpiration {
+				sess.resetMaxAge(opts.CookieTemplate.MaxAge)
+			}
+			if sess.isRegenerated() {
+				// Move the session to its new ID in the store
+				err = moveSession(ctx, opts.Store, sess)
+			} else if !sess.IsNew() && !modified() {
+				// Do not save if content is the same, unless session is new (to avoid
+				// creating a new session and sending a cookie on each successive request).
+				// The expiration and the last access time are saved without the content.
+				ghost.LogFn("ghost.session : no changes to save to store")
+				if opts.SlidingExpiration || opts.IdleTimeout > 0 {
+					err = touchSession(ctx, opts.Store, sess)
+				}
+			} else {
+				err = saveSession(ctx, opts, sess, version)
+			}
 		}
-		err = opts.Store.Set(sess)
 		if err != nil {
 			ghost.LogFn("ghost.session : error saving session to store : %s", err)
+			if opts.OnError != nil {
+				opts.OnError(srw, r, err)
+			}
 		}
 	}
 }
 
+// Get the session from the store, using the context if the store supports it.
+func getSession(ctx context.Context, store SessionStore, id string) (*Session, error) {
+	if cs, ok := store.(ContextSessionStore); ok {
+		return cs.GetContext(ctx, id)
+	}
+	return store.Get(id)
+}
+
+// Save the session in the store, using the context if the store supports it.
+func setSession(ctx context.Context, store SessionStore, sess *Session) error {
+	if cs, ok := store.(ContextSessionStore); ok {
+		return cs.SetContext(ctx, sess)
+	}
+	return store.Set(sess)
+}
+
+// Delete the session from the store, using the context if the store supports it.
+func deleteSession(ctx context.Context, store SessionStore, id string) error {
+	if cs, ok := store.(ContextSessionStore); ok {
+		return cs.DeleteContext(ctx, id)
+	}
+	return store.Delete(id)
+}
+
+// Save the session in the store with the next version, applying the conflict policy
+// if the store supports optimistic concurrency. The version is the version of the
+// session when it was loaded. A session loaded from the store is only saved if it is
+// still in the store, so that a session destroyed by a concurrent request is not
+// created again.
+func saveSession(ctx context.Context, opts *SessionOptions, sess *Session, version int64) error {
+	sess.internalSession.Version = version + 1
+	save := func() error {
+		if sess.IsNew() {
+			return setSession(ctx, opts.Store, sess)
+		}
+		return replaceSession(ctx, opts.Store, sess, sess.ID())
+	}
+	cas, ok := opts.Store.(SessionCompareAndSetter)
+	if !ok || opts.ConflictPolicy == ConflictLastWriteWins || (!sess.IsNew() && version == 0) {
+		// A loaded session with version 0 was saved before the versions, it cannot be
+		// compared and set without creating it again if it was deleted.
+		return save()
+	}
+	for i := 0; ; i++ {
+		ok, err := compareAndSetSession(ctx, cas, sess, version)
+		if err == ErrCompareAndSetUnsupported {
+			// Wraps a store that does not support it (i.e. CacheStore)
+			return save()
+		}
+		if err != nil || ok {
+			return err
+		}
+		if opts.ConflictPolicy != ConflictMerge || i == maxMergeRetries {
+			return ErrSessionConflict
+		}
+		stored, err := getSession(ctx, opts.Store, sess.ID())
+		if err != nil {
+			return err
+		}
+		if stored == nil {
+			// Deleted by the concurrent request (i.e. destroyed), do not create it again
+			return ErrSessionConflict
+		}
+		if err = opts.Merge(sess, stored); err != nil {
+			return err
+		}
+		version = stored.Version()
+		sess.internalSession.Version = version + 1
+	}
+}
+
+// Delete the destroyed session from the store, including its old ID if it was
+// regenerated during the request.
+func destroySession(ctx context.Context, store SessionStore, sess *Session) error {
+	ids := []string{sess.oldID}
+	if !sess.IsNew() {
+		ids = append(ids, sess.ID())
+	}
+	for _, id := range ids {
+		if id == "" {
+			continue
+		}
+		if err := deleteSession(ctx, store, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Save the session under its regenerated ID and delete the old ID from the store,
+// if the old ID is still in the store.
+func moveSession(ctx context.Context, store SessionStore, sess *Session) error {
+	if err := replaceSession(ctx, store, sess, sess.oldID); err != nil {
+		return err
+	}
+	sess.oldID = ""
+	return nil
+}
+
+// Save the session in the store if its stored version is version, using the context
+// if the store supports it.
+func compareAndSetSession(ctx context.Context, cas SessionCompareAndSetter, sess *Session, version int64) (bool, error) {
+	if ccas, ok := cas.(ContextSessionCompareAndSetter); ok {
+		return ccas.CompareAndSetContext(ctx, sess, version)
+	}
+	return cas.CompareAndSet(sess, version)
+}
+
+// Save the session in the store if id is still in the store, and delete id if it is
+// not the ID of the session. ErrSessionGone is returned if id is not in the store.
+func replaceSession(ctx context.Context, store SessionStore, sess *Session, id string) error {
+	var ok bool
+	var err error
+	if crs, isCrs := store.(ContextSessionReplacer); isCrs {
+		ok, err = crs.ReplaceContext(ctx, sess, id)
+	} else if rs, isRs := store.(SessionReplacer); isRs {
+		ok, err = rs.Replace(sess, id)
+	} else {
+		// Not atomic, the session may still be deleted between the check and the save
+		var cur *Session
+		if cur, err = getSession(ctx, store, id); err == nil && cur != nil {
+			ok = true
+			if err = setSession(ctx, store, sess); err == nil && id != sess.ID() {
+				err = deleteSession(ctx, store, id)
+			}
+		}
+	}
+	if err == nil && !ok {
+		err = ErrSessionGone
+	}
+	return err
+}
+
+// Reset the expiration and save the last access time of the session in the store,
+// using the context if the store supports it. If the store cannot touch the session
+// on its own, the session is saved again if it is still in the store.
+func touchSession(ctx context.Context, store SessionStore, sess *Session) error {
+	if cst, ok := store.(ContextSessionToucher); ok {
+		return cst.TouchContext(ctx, sess)
+	}
+	if st, ok := store.(SessionToucher); ok {
+		return st.Touch(sess)
+	}
+	if err := replaceSession(ctx, store, sess, sess.ID()); err != ErrSessionGone {
+		return err
+	}
+	// Destroyed by a concurrent request, there is nothing to touch
+	return nil
+}
+
 // Helper function to retrieve the session for the current request.
 func GetSession(w http.ResponseWriter) (*Session, bool) {
 	ss, ok := getSessionWriter(w)
@@ -275,6 +834,15 @@ func GetSessionStore(w http.ResponseWriter) (SessionStore, bool) {
 	return nil, false
 }
 
+// Helper function to check if the response headers (with the session cookie or
+// token) are already written, so that the response cannot be changed. It is meant
+// for OnError, which receives the errors of the save or delete of the session after
+// the wrapped handler returned.
+func IsResponseCommitted(w http.ResponseWriter) bool {
+	ss, ok := getSessionWriter(w)
+	return ok && ss.sessSent
+}
+
 // Internal helper function to retrieve the session writer object.
 func getSessionWriter(w http.ResponseWriter) (*sessResponseWriter, bool) {
 	ss, ok := GetResponseWriter(w, func(tst http.ResponseWriter) bool {
@@ -287,21 +855,110 @@ func getSessionWriter(w http.ResponseWriter) (*sessResponseWriter, bool) {
 	return nil, false
 }
 
-// Parse a signed cookie and return the cookie value
-func parseSignedCookie(ck *http.Cookie, secret string) (string, error) {
-	var val string
+// Check that the browsers accept the cookie template, the error describes the
+// first rule that is broken.
+func validateCookieTemplate(ck *http.Cookie) error {
+	invalid := func(msg string) error {
+		return fmt.Errorf("%w : %s", ErrInvalidCookie, msg)
+	}
+	switch ck.SameSite {
+	case 0, http.SameSiteDefaultMode, http.SameSiteLaxMode, http.SameSiteStrictMode:
+	case http.SameSiteNoneMode:
+		if !ck.Secure {
+			return invalid("SameSite=None requires Secure")
+		}
+	default:
+		return invalid(fmt.Sprintf("unknown SameSite mode %d", ck.SameSite))
+	}
+	// Browsers match the prefixes case-insensitively
+	name := strings.ToLower(ck.Name)
+	switch {
+	case strings.HasPrefix(name, "__host-"):
+		if !ck.Secure {
+			return invalid(fmt.Sprintf("cookie %q requires Secure", ck.Name))
+		}
+		if ck.Domain != "" {
+			return invalid(fmt.Sprintf("cookie %q must not have a Domain, got %q", ck.Name, ck.Domain))
+		}
+		if ck.Path != "/" {
+			return invalid(fmt.Sprintf("cookie %q requires the Path \"/\", got %q", ck.Name, ck.Path))
+		}
+	case strings.HasPrefix(name, "__secure-"):
+		if !ck.Secure {
+			return invalid(fmt.Sprintf("cookie %q requires Secure", ck.Name))
+		}
+	}
+	return nil
+}
+
+// Get the session token of the request, from the first transport of the options
+// that is present in the request. The token is returned as a cookie with the name
+// of the cookie template, so that it is verified the same way as the cookie.
+func getSessionToken(r *http.Request, opts *SessionOptions) (*http.Cookie, SessionTransport, error) {
+	for _, t := range opts.Transports {
+		var val string
+		switch t {
+		case TransportCookie:
+			if ck, err := r.Cookie(opts.CookieTemplate.Name); err == nil {
+				val = ck.Value
+			}
+		case TransportHeader:
+			val = r.Header.Get(opts.TokenHeader)
+		case TransportBearer:
+			auth := r.Header.Get("Authorization")
+			if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+				val = strings.TrimSpace(auth[7:])
+			}
+		}
+		if val != "" {
+			return &http.Cookie{Name: opts.CookieTemplate.Name, Value: val}, t, nil
+		}
+	}
+	return nil, TransportCookie, ErrNoSessionToken
+}
+
+// Create the secure cookie codecs for the secrets of the options, the current
+// secret first. If there is an encryption key, the encrypting codecs come first,
+// followed by the signing-only codecs if unencrypted cookies are allowed.
+func newSecureCookies(opts *SessionOptions) []*securecookie.SecureCookie {
+	var scks []*securecookie.SecureCookie
+	var blocks [][]byte
+	if len(opts.EncryptionKey) > 0 {
+		blocks = append(blocks, opts.EncryptionKey)
+		if opts.AllowUnencrypted {
+			blocks = append(blocks, nil)
+		}
+	} else {
+		blocks = append(blocks, nil)
+	}
+	for _, block := range blocks {
+		for _, secret := range append([]string{opts.Secret}, opts.Secrets...) {
+			if secret != "" {
+				scks = append(scks, securecookie.New([]byte(secret), block))
+			}
+		}
+	}
+	return scks
+}
 
-	sck := securecookie.New([]byte(secret), nil)
-	err := sck.Decode(ck.Name, ck.Value, &val)
-	if err != nil {
-		return "", err
+// Parse a signed cookie and return the cookie value. The cookie is verified with
+// each codec in turn, the returned flag is true if the cookie was verified by an old
+// codec (not the first one), so that it must be signed again.
+func parseSignedCookie(ck *http.Cookie, scks []*securecookie.SecureCookie) (string, bool, error) {
+	var (
+		val string
+		err error
+	)
+	for i, sck := range scks {
+		if err = sck.Decode(ck.Name, ck.Value, &val); err == nil {
+			return val, i > 0, nil
+		}
 	}
-	return val, nil
+	return "", false, err
 }
 
 // Sign the specified cookie's value
-func signCookie(ck *http.Cookie, secret string) error {
-	sck := securecookie.New([]byte(secret), nil)
+func signCookie(ck *http.Cookie, sck *securecookie.SecureCookie) error {
 	enc, err := sck.Encode(ck.Name, ck.Value)
 	if err != nil {
 		return err
@@ -310,9 +967,16 @@ func signCookie(ck *http.Cookie, secret string) error {
 	return nil
 }
 
-// Compute a CRC32 hash of the session's JSON-encoded contents.
-func hash(s *Session) uint32 {
-	data, err := json.Marshal(s)
+// Check if the session's contents changed since the original hash was computed.
+func isModified(c SessionCodec, s *Session, oriHash uint32) bool {
+	newHash := hash(c, s)
+	return oriHash != newHash || newHash == 0
+}
+
+// Compute a CRC32 hash of the session's encoded contents. The encoding must be
+// deterministic, or an unchanged session may be reported as modified.
+func hash(c SessionCodec, s *Session) uint32 {
+	data, err := c.Encode(s)
 	if err != nil {
 		ghost.LogFn("ghost.session : error hash : %s", err)
 		return 0 // 0 is always treated as "modified" session content
@@ -1,13 +1,18 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/PuerkitoBio/ghost/handlers/internal/redisstub"
 )
 
 var (
@@ -16,14 +21,26 @@ var (
 )
 
 func TestSession(t *testing.T) {
+	srv, err := redisstub.NewServer()
+	if err != nil {
+		panic(err)
+	}
+	defer srv.Close()
+	rs, err := NewRedisStore(&RedisStoreOptions{
+		Network:   "tcp",
+		Address:   srv.Addr(),
+		Database:  1,
+		KeyPrefix: "sess",
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer rs.Close()
+	ms := NewMemoryStore(1)
+	defer ms.Close()
 	stores := map[string]SessionStore{
-		"memory": NewMemoryStore(1),
-		"redis": NewRedisStore(&RedisStoreOptions{
-			Network:   "tcp",
-			Address:   ":6379",
-			Database:  1,
-			KeyPrefix: "sess",
-		}),
+		"memory": ms,
+		"redis":  rs,
 	}
 	for k, v := range stores {
 		t.Logf("testing session with %s store\n", k)
@@ -36,8 +53,22 @@ func TestSession(t *testing.T) {
 		testSessionExpires(t)
 		t.Log("SessionBeforeExpires")
 		testSessionBeforeExpires(t)
+		t.Log("SessionSlidingExpiration")
+		testSessionSlidingExpiration(t)
+		t.Log("SessionTimeouts")
+		testSessionTimeouts(t)
+		t.Log("SessionRegenerate")
+		testSessionRegenerate(t)
+		t.Log("SessionDestroy")
+		testSessionDestroy(t)
+		t.Log("SecretRotation")
+		testSecretRotation(t)
+		t.Log("EncryptedCookie")
+		testEncryptedCookie(t)
 		t.Log("PanicIfNoSecret")
 		testPanicIfNoSecret(t)
+		t.Log("PanicIfInvalidEncryptionKey")
+		testPanicIfInvalidEncryptionKey(t)
 		t.Log("InvalidPath")
 		testInvalidPath(t)
 		t.Log("ValidSubPath")
@@ -54,6 +85,10 @@ func setupTest(f func(w http.ResponseWriter, r *http.Request), ckPath string, se
 	}
 	opts.CookieTemplate.Secure = secure
 	opts.CookieTemplate.MaxAge = maxAge
+	return setupTestOpts(f, opts)
+}
+
+func setupTestOpts(f func(w http.ResponseWriter, r *http.Request), opts *SessionOptions) *httptest.Server {
 	h := SessionHandler(http.HandlerFunc(f), opts)
 	return httptest.NewServer(h)
 }
@@ -77,7 +112,7 @@ func testSessionExists(t *testing.T) {
 	s := setupTest(func(w http.ResponseWriter, r *http.Request) {
 		ssn, ok := GetSession(w)
 		if assertTrue(ok, "expected session to be non-nil, got nil", t) {
-			ssn.Data["foo"] = "bar"
+			ssn.Set("foo", "bar")
 			assertTrue(ssn.Data["foo"] == "bar", fmt.Sprintf("expected ssn[foo] to be 'bar', got %v", ssn.Data["foo"]), t)
 		}
 		w.Write([]byte("ok"))
@@ -98,7 +133,7 @@ func testSessionPersists(t *testing.T) {
 			panic("session not found!")
 		}
 		if cnt == 0 {
-			ssn.Data["foo"] = "bar"
+			ssn.Set("foo", "bar")
 			w.Write([]byte("ok"))
 			cnt++
 		} else {
@@ -191,6 +226,315 @@ func testSessionBeforeExpires(t *testing.T) {
 	assertTrue(sid1 == sid2, "expected session IDs to be the same, got different", t)
 }
 
+func testSessionSlidingExpiration(t *testing.T) {
+	opts := NewSessionOptions(store, secret)
+	opts.CookieTemplate.MaxAge = 1 // Expire in 1 second
+	opts.SlidingExpiration = true
+	s := setupTestOpts(func(w http.ResponseWriter, r *http.Request) {
+		ssn, ok := GetSession(w)
+		if !ok {
+			panic("session not found!")
+		}
+		w.Write([]byte(ssn.ID()))
+	}, opts)
+	defer s.Close()
+
+	// 1st call, create the session
+	res := doRequest(s.URL, true)
+	assertStatus(http.StatusOK, res.StatusCode, t)
+	id1, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		panic(err)
+	}
+	res.Body.Close()
+	time.Sleep(600 * time.Millisecond)
+
+	// 2nd call, the expiration is pushed back and the cookie is sent again
+	res = doRequest(s.URL, false)
+	assertStatus(http.StatusOK, res.StatusCode, t)
+	id2, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		panic(err)
+	}
+	res.Body.Close()
+	assertTrue(len(res.Cookies()) == 1, fmt.Sprintf("expected 2nd response to have 1 cookie, got %d", len(res.Cookies())), t)
+	time.Sleep(600 * time.Millisecond)
+
+	// 3rd call, past the original expiration, the session is still alive
+	res = doRequest(s.URL, false)
+	assertStatus(http.StatusOK, res.StatusCode, t)
+	id3, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		panic(err)
+	}
+	res.Body.Close()
+	sid1, sid2, sid3 := string(id1), string(id2), string(id3)
+	assertTrue(sid1 == sid2 && sid2 == sid3, "expected session IDs to be the same, got different", t)
+}
+
+func testSessionRegenerate(t *testing.T) {
+	cnt := 0
+	s := setupTest(func(w http.ResponseWriter, r *http.Request) {
+		ssn, ok := GetSession(w)
+		if !ok {
+			panic("session not found!")
+		}
+		switch cnt {
+		case 0:
+			ssn.Set("foo", "bar")
+		case 1:
+			if err := ssn.Regenerate(); err != nil {
+				panic(err)
+			}
+		}
+		cnt++
+		w.Write([]byte(ssn.ID()))
+	}, "", false, 0)
+	defer s.Close()
+
+	// 1st call, create the session
+	res := doRequest(s.URL, true)
+	assertStatus(http.StatusOK, res.StatusCode, t)
+	id1, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		panic(err)
+	}
+	res.Body.Close()
+
+	// 2nd call, regenerate the session ID
+	res = doRequest(s.URL, false)
+	assertStatus(http.StatusOK, res.StatusCode, t)
+	id2, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		panic(err)
+	}
+	res.Body.Close()
+	sid1, sid2 := string(id1), string(id2)
+	assertTrue(len(res.Cookies()) == 1, fmt.Sprintf("expected 2nd response to have 1 cookie, got %d", len(res.Cookies())), t)
+	assertTrue(sid1 != sid2, "expected session IDs to be different, got same", t)
+	ssn, _ := store.Get(sid1)
+	assertTrue(ssn == nil, "expected old session ID to be deleted from the store", t)
+	ssn, _ = store.Get(sid2)
+	if assertTrue(ssn != nil, "expected new session ID to be in the store", t) {
+		assertTrue(ssn.Data["foo"] == "bar", fmt.Sprintf("expected ssn[foo] to be 'bar', got %v", ssn.Data["foo"]), t)
+	}
+
+	// 3rd call, the new session ID is used
+	res = doRequest(s.URL, false)
+	assertStatus(http.StatusOK, res.StatusCode, t)
+	assertBody(id2, res, t)
+	assertTrue(len(res.Cookies()) == 0, fmt.Sprintf("expected 3rd response to have no cookie, got %d", len(res.Cookies())), t)
+}
+
+func testSessionDestroy(t *testing.T) {
+	cnt := 0
+	s := setupTest(func(w http.ResponseWriter, r *http.Request) {
+		ssn, ok := GetSession(w)
+		if !ok {
+			panic("session not found!")
+		}
+		switch cnt {
+		case 0:
+			ssn.Set("foo", "bar")
+		case 1:
+			ssn.Destroy()
+		}
+		cnt++
+		w.Write([]byte(ssn.ID()))
+	}, "", false, 0)
+	defer s.Close()
+
+	// 1st call, create the session
+	res := doRequest(s.URL, true)
+	assertStatus(http.StatusOK, res.StatusCode, t)
+	id1, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		panic(err)
+	}
+	res.Body.Close()
+
+	// 2nd call, destroy the session
+	res = doRequest(s.URL, false)
+	assertStatus(http.StatusOK, res.StatusCode, t)
+	assertBody(id1, res, t)
+	if assertTrue(len(res.Cookies()) == 1, fmt.Sprintf("expected 2nd response to have 1 cookie, got %d", len(res.Cookies())), t) {
+		ck := res.Cookies()[0]
+		assertTrue(ck.Name == defaultCookieName, fmt.Sprintf("expected cookie name to be %s, got %s", defaultCookieName, ck.Name), t)
+		assertTrue(ck.Path == "/", fmt.Sprintf("expected cookie path to be /, got %s", ck.Path), t)
+		assertTrue(ck.MaxAge < 0, fmt.Sprintf("expected cookie to be expired, got max age %d", ck.MaxAge), t)
+	}
+	ssn, _ := store.Get(string(id1))
+	assertTrue(ssn == nil, "expected session to be deleted from the store", t)
+
+	// 3rd call, a new session is created
+	res = doRequest(s.URL, false)
+	assertStatus(http.StatusOK, res.StatusCode, t)
+	id3, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		panic(err)
+	}
+	res.Body.Close()
+	assertTrue(len(res.Cookies()) == 1, fmt.Sprintf("expected 3rd response to have 1 cookie, got %d", len(res.Cookies())), t)
+	assertTrue(string(id1) != string(id3), "expected session IDs to be different, got same", t)
+}
+
+func testSessionTimeouts(t *testing.T) {
+	opts := NewSessionOptions(store, secret)
+	opts.IdleTimeout = 200 * time.Millisecond
+	opts.AbsoluteTimeout = 500 * time.Millisecond
+	s := setupTestOpts(func(w http.ResponseWriter, r *http.Request) {
+		ssn, _ := GetSession(w)
+		w.Write([]byte(ssn.ID()))
+	}, opts)
+	defer s.Close()
+
+	// Accessed before the idle timeout, until the absolute timeout
+	res, id1 := doRequestWithCookie(s.URL, nil)
+	if !assertTrue(len(res.Cookies()) == 1, fmt.Sprintf("expected 1 cookie, got %d", len(res.Cookies())), t) {
+		return
+	}
+	ck := res.Cookies()[0]
+	for i := 0; i < 3; i++ {
+		time.Sleep(120 * time.Millisecond)
+		_, id := doRequestWithCookie(s.URL, ck)
+		assertTrue(id == id1, fmt.Sprintf("%d: expected session IDs to be the same, got different", i), t)
+	}
+	time.Sleep(160 * time.Millisecond)
+	_, id2 := doRequestWithCookie(s.URL, ck)
+	assertTrue(id2 != id1, "expected session to be expired by the absolute timeout", t)
+	ssn, _ := store.Get(id1)
+	assertTrue(ssn == nil, "expected expired session to be deleted from the store", t)
+
+	// Idle for longer than the idle timeout
+	res, id3 := doRequestWithCookie(s.URL, nil)
+	ck = res.Cookies()[0]
+	time.Sleep(250 * time.Millisecond)
+	_, id4 := doRequestWithCookie(s.URL, ck)
+	assertTrue(id4 != id3, "expected session to be expired by the idle timeout", t)
+}
+
+// Send a request with the specified cookie (no cookie jar), return the response
+// and its body.
+func doRequestWithCookie(u string, ck *http.Cookie) (*http.Response, string) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		panic(err)
+	}
+	if ck != nil {
+		req.AddCookie(ck)
+	}
+	res, err := new(http.Client).Do(req)
+	if err != nil {
+		panic(err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		panic(err)
+	}
+	return res, string(b)
+}
+
+func testSecretRotation(t *testing.T) {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		ssn, ok := GetSession(w)
+		if !ok {
+			panic("session not found!")
+		}
+		w.Write([]byte(ssn.ID()))
+	}
+	oldOpts := NewSessionOptions(store, "old secret")
+	s1 := setupTestOpts(f, oldOpts)
+	defer s1.Close()
+	rotOpts := NewSessionOptions(store, "new secret")
+	rotOpts.Secrets = []string{"old secret"}
+	s2 := setupTestOpts(f, rotOpts)
+	defer s2.Close()
+	s3 := setupTestOpts(f, NewSessionOptions(store, "new secret"))
+	defer s3.Close()
+
+	// 1st call, cookie signed with the old secret
+	res, id1 := doRequestWithCookie(s1.URL, nil)
+	if !assertTrue(len(res.Cookies()) == 1, fmt.Sprintf("expected 1st response to have 1 cookie, got %d", len(res.Cookies())), t) {
+		return
+	}
+	ck1 := res.Cookies()[0]
+
+	// 2nd call, cookie accepted and signed again with the new secret
+	res, id2 := doRequestWithCookie(s2.URL, ck1)
+	assertTrue(id1 == id2, "expected session IDs to be the same, got different", t)
+	if !assertTrue(len(res.Cookies()) == 1, fmt.Sprintf("expected 2nd response to have 1 cookie, got %d", len(res.Cookies())), t) {
+		return
+	}
+	ck2 := res.Cookies()[0]
+
+	// 3rd call, cookie signed again with the new secret is not sent again
+	res, id3 := doRequestWithCookie(s2.URL, ck2)
+	assertTrue(id1 == id3, "expected session IDs to be the same, got different", t)
+	assertTrue(len(res.Cookies()) == 0, fmt.Sprintf("expected 3rd response to have no cookie, got %d", len(res.Cookies())), t)
+
+	// 4th call, with only the new secret
+	_, id4 := doRequestWithCookie(s3.URL, ck2)
+	assertTrue(id1 == id4, "expected session IDs to be the same, got different", t)
+	_, id5 := doRequestWithCookie(s3.URL, ck1)
+	assertTrue(id1 != id5, "expected session IDs to be different, got same", t)
+}
+
+func testEncryptedCookie(t *testing.T) {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		ssn, ok := GetSession(w)
+		if !ok {
+			panic("session not found!")
+		}
+		w.Write([]byte(ssn.ID()))
+	}
+	key := []byte("0123456789abcdef")
+	s1 := setupTestOpts(f, NewSessionOptions(store, secret))
+	defer s1.Close()
+	migOpts := NewSessionOptions(store, secret)
+	migOpts.EncryptionKey = key
+	migOpts.AllowUnencrypted = true
+	s2 := setupTestOpts(f, migOpts)
+	defer s2.Close()
+	encOpts := NewSessionOptions(store, secret)
+	encOpts.EncryptionKey = key
+	s3 := setupTestOpts(f, encOpts)
+	defer s3.Close()
+
+	// 1st call, cookie only signed
+	res, id1 := doRequestWithCookie(s1.URL, nil)
+	if !assertTrue(len(res.Cookies()) == 1, fmt.Sprintf("expected 1st response to have 1 cookie, got %d", len(res.Cookies())), t) {
+		return
+	}
+	ck1 := res.Cookies()[0]
+
+	// 2nd call, signed cookie accepted during migration, and sent again encrypted
+	res, id2 := doRequestWithCookie(s2.URL, ck1)
+	assertTrue(id1 == id2, "expected session IDs to be the same, got different", t)
+	if !assertTrue(len(res.Cookies()) == 1, fmt.Sprintf("expected 2nd response to have 1 cookie, got %d", len(res.Cookies())), t) {
+		return
+	}
+	ck2 := res.Cookies()[0]
+
+	// 3rd call, encrypted cookie accepted, signed cookie refused
+	res, id3 := doRequestWithCookie(s3.URL, ck2)
+	assertTrue(id1 == id3, "expected session IDs to be the same, got different", t)
+	assertTrue(len(res.Cookies()) == 0, fmt.Sprintf("expected 3rd response to have no cookie, got %d", len(res.Cookies())), t)
+	_, id4 := doRequestWithCookie(s3.URL, ck1)
+	assertTrue(id1 != id4, "expected session IDs to be different, got same", t)
+
+	// The encrypted cookie is refused without the encryption key
+	_, id5 := doRequestWithCookie(s1.URL, ck2)
+	assertTrue(id1 != id5, "expected session IDs to be different, got same", t)
+}
+
+func testPanicIfInvalidEncryptionKey(t *testing.T) {
+	defer assertPanic(t)
+	opts := NewSessionOptions(store, secret)
+	opts.EncryptionKey = []byte("short")
+	SessionHandler(http.NotFoundHandler(), opts)
+}
+
 func testPanicIfNoSecret(t *testing.T) {
 	defer assertPanic(t)
 	SessionHandler(http.NotFoundHandler(), NewSessionOptions(nil, ""))
@@ -256,3 +600,547 @@ func xtestSecureOverHttps(t *testing.T) {
 	assertBody([]byte("ok"), res, t)
 	assertTrue(len(res.Cookies()) == 1, fmt.Sprintf("expected response to have 1 cookie, got %d", len(res.Cookies())), t)
 }
+
+// A store that fails on demand, and records the contexts it receives.
+type failingStore struct {
+	*MemoryStore
+	fail bool
+	ctxs int
+}
+
+var errStoreDown = errors.New("store is down")
+
+func (this *failingStore) GetContext(ctx context.Context, id string) (*Session, error) {
+	this.ctxs++
+	if this.fail {
+		return nil, errStoreDown
+	}
+	return this.Get(id)
+}
+
+func (this *failingStore) SetContext(ctx context.Context, sess *Session) error {
+	this.ctxs++
+	if this.fail {
+		return errStoreDown
+	}
+	return this.Set(sess)
+}
+
+func (this *failingStore) DeleteContext(ctx context.Context, id string) error {
+	this.ctxs++
+	if this.fail {
+		return errStoreDown
+	}
+	return this.Delete(id)
+}
+
+func TestSessionOnError(t *testing.T) {
+	fs := &failingStore{MemoryStore: NewMemoryStore(1)}
+	defer fs.Close()
+	var errs []error
+	var committed []bool
+	opts := NewSessionOptions(fs, secret)
+	opts.OnError = func(w http.ResponseWriter, r *http.Request, err error) bool {
+		errs = append(errs, err)
+		committed = append(committed, IsResponseCommitted(w))
+		if !IsResponseCommitted(w) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		}
+		return true
+	}
+	called := 0
+	s := setupTestOpts(func(w http.ResponseWriter, r *http.Request) {
+		called++
+		ssn, _ := GetSession(w)
+		ssn.Set("foo", called)
+		if r.URL.Path != "/silent" {
+			w.Write([]byte(ssn.ID()))
+		}
+	}, opts)
+	defer s.Close()
+
+	// 1st call, store is up, the session is saved with the context method
+	res, id1 := doRequestWithCookie(s.URL, nil)
+	assertStatus(http.StatusOK, res.StatusCode, t)
+	assertTrue(fs.ctxs == 1, fmt.Sprintf("expected 1 context call, got %d", fs.ctxs), t)
+	if !assertTrue(len(res.Cookies()) == 1, fmt.Sprintf("expected 1 cookie, got %d", len(res.Cookies())), t) {
+		return
+	}
+	ck := res.Cookies()[0]
+
+	// 2nd call, store is down, the error handler stops the request
+	fs.fail = true
+	res, _ = doRequestWithCookie(s.URL, ck)
+	assertStatus(http.StatusServiceUnavailable, res.StatusCode, t)
+	assertTrue(called == 1, fmt.Sprintf("expected handler to be called once, got %d", called), t)
+	assertTrue(len(errs) == 1 && errs[0] == errStoreDown, fmt.Sprintf("expected 1 store error, got %v", errs), t)
+
+	// 3rd call, no cookie so no load, the save error is reported once the response
+	// is committed
+	res, _ = doRequestWithCookie(s.URL, nil)
+	assertStatus(http.StatusOK, res.StatusCode, t)
+	assertTrue(len(errs) == 2, fmt.Sprintf("expected 2 store errors, got %d", len(errs)), t)
+	assertTrue(committed[1], "expected the response to be committed", t)
+
+	// The handler did not write the response, the error handler can
+	res, _ = doRequestWithCookie(s.URL+"/silent", nil)
+	assertStatus(http.StatusServiceUnavailable, res.StatusCode, t)
+	assertTrue(len(errs) == 3 && !committed[2], fmt.Sprintf("expected the response not to be committed, got %v", committed), t)
+
+	// 4th call, store is up again, the session is loaded
+	fs.fail = false
+	res, id4 := doRequestWithCookie(s.URL, ck)
+	assertStatus(http.StatusOK, res.StatusCode, t)
+	assertTrue(id1 == id4, "expected session IDs to be the same, got different", t)
+}
+
+// A store that counts the number of sessions saved.
+type countingStore struct {
+	*MemoryStore
+	sets int
+}
+
+func (this *countingStore) Set(sess *Session) error {
+	this.sets++
+	return this.MemoryStore.Set(sess)
+}
+
+func (this *countingStore) Replace(sess *Session, id string) (bool, error) {
+	this.sets++
+	return this.MemoryStore.Replace(sess, id)
+}
+
+func TestSessionExplicitModified(t *testing.T) {
+	cs := &countingStore{MemoryStore: NewMemoryStore(1)}
+	defer cs.Close()
+	opts := NewSessionOptions(cs, secret)
+	s := setupTestOpts(func(w http.ResponseWriter, r *http.Request) {
+		ssn, _ := GetSession(w)
+		switch r.URL.Path {
+		case "/set":
+			ssn.Set("foo", []string{"bar"})
+		case "/direct":
+			ssn.Data["foo"] = []string{"baz"}
+		case "/inplace":
+			ssn.Get("foo").([]string)[0] = "qux"
+			ssn.MarkModified()
+		case "/delete":
+			ssn.Delete("foo")
+		}
+		w.Write([]byte(ssn.ID()))
+	}, opts)
+	defer s.Close()
+
+	// New session, always saved
+	res, _ := doRequestWithCookie(s.URL+"/set", nil)
+	if !assertTrue(len(res.Cookies()) == 1, fmt.Sprintf("expected 1 cookie, got %d", len(res.Cookies())), t) {
+		return
+	}
+	ck := res.Cookies()[0]
+	cases := []struct {
+		path string
+		sets int
+	}{
+		{"/", 1},
+		{"/set", 2},
+		{"/direct", 2},
+		{"/inplace", 3},
+		{"/", 3},
+		{"/delete", 4},
+		{"/delete", 4},
+	}
+	for _, c := range cases {
+		doRequestWithCookie(s.URL+c.path, ck)
+		assertTrue(cs.sets == c.sets, fmt.Sprintf("%s: expected %d saves, got %d", c.path, c.sets, cs.sets), t)
+	}
+}
+
+func TestSessionHashModified(t *testing.T) {
+	cs := &countingStore{MemoryStore: NewMemoryStore(1)}
+	defer cs.Close()
+	opts := NewSessionOptions(cs, secret)
+	opts.HashModified = true
+	s := setupTestOpts(func(w http.ResponseWriter, r *http.Request) {
+		ssn, _ := GetSession(w)
+		if r.URL.Path == "/direct" {
+			ssn.Data["foo"] = r.URL.Query().Get("v")
+		}
+		w.Write([]byte(ssn.ID()))
+	}, opts)
+	defer s.Close()
+
+	res, _ := doRequestWithCookie(s.URL, nil)
+	if !assertTrue(len(res.Cookies()) == 1, fmt.Sprintf("expected 1 cookie, got %d", len(res.Cookies())), t) {
+		return
+	}
+	ck := res.Cookies()[0]
+	cases := []struct {
+		path string
+		sets int
+	}{
+		{"/", 1},
+		{"/direct?v=bar", 2},
+		{"/direct?v=bar", 2},
+		{"/direct?v=baz", 3},
+	}
+	for _, c := range cases {
+		doRequestWithCookie(s.URL+c.path, ck)
+		assertTrue(cs.sets == c.sets, fmt.Sprintf("%s: expected %d saves, got %d", c.path, c.sets, cs.sets), t)
+	}
+}
+
+func TestSessionAccessors(t *testing.T) {
+	ssn := newSession(0)
+	assertTrue(!ssn.IsModified(), "expected new session to be unmodified", t)
+	assertTrue(ssn.Get("foo") == nil, fmt.Sprintf("expected foo to be nil, got %v", ssn.Get("foo")), t)
+	ssn.Delete("foo")
+	assertTrue(!ssn.IsModified(), "expected session to be unmodified after deleting a missing key", t)
+	ssn.Set("foo", "bar")
+	assertTrue(ssn.IsModified(), "expected session to be modified after Set", t)
+	assertTrue(ssn.Get("foo") == "bar", fmt.Sprintf("expected foo to be bar, got %v", ssn.Get("foo")), t)
+	assertTrue(ssn.Data["foo"] == "bar", fmt.Sprintf("expected Data[foo] to be bar, got %v", ssn.Data["foo"]), t)
+	ssn.Clear()
+	assertTrue(len(ssn.Data) == 0, fmt.Sprintf("expected empty data after Clear, got %d keys", len(ssn.Data)), t)
+}
+
+func TestSessionConflictPolicy(t *testing.T) {
+	merge := func(sess, stored *Session) error {
+		for k, v := range stored.Data {
+			if _, ok := sess.Data[k]; !ok {
+				sess.Data[k] = v
+			}
+		}
+		return nil
+	}
+	cases := []struct {
+		policy ConflictPolicy
+		keys   []string
+		err    error
+	}{
+		{ConflictLastWriteWins, []string{"a"}, nil},
+		{ConflictFail, []string{"b"}, ErrSessionConflict},
+		{ConflictMerge, []string{"a", "b"}, nil},
+	}
+	for _, c := range cases {
+		ms := NewMemoryStore(1)
+		defer ms.Close()
+		opts := NewSessionOptions(ms, secret)
+		opts.ConflictPolicy = c.policy
+		opts.Merge = merge
+		var errs []error
+		opts.OnError = func(w http.ResponseWriter, r *http.Request, err error) bool {
+			errs = append(errs, err)
+			return false
+		}
+		var ck *http.Cookie
+		var srv *httptest.Server
+		srv = setupTestOpts(func(w http.ResponseWriter, r *http.Request) {
+			ssn, _ := GetSession(w)
+			switch r.URL.Path {
+			case "/a":
+				// A concurrent request saves the session while this one runs
+				ssn.Set("a", true)
+				doRequestWithCookie(srv.URL+"/b", ck)
+			case "/b":
+				ssn.Set("b", true)
+			}
+			w.Write([]byte(ssn.ID()))
+		}, opts)
+
+		res, id := doRequestWithCookie(srv.URL, nil)
+		if assertTrue(len(res.Cookies()) == 1, fmt.Sprintf("%d: expected 1 cookie, got %d", c.policy, len(res.Cookies())), t) {
+			ck = res.Cookies()[0]
+			doRequestWithCookie(srv.URL+"/a", ck)
+			ssn, _ := ms.Get(id)
+			assertTrue(len(ssn.Data) == len(c.keys), fmt.Sprintf("%d: expected %d keys, got %v", c.policy, len(c.keys), ssn.Data), t)
+			for _, k := range c.keys {
+				assertTrue(ssn.Get(k) == true, fmt.Sprintf("%d: expected key %s to be saved", c.policy, k), t)
+			}
+			if c.err != nil {
+				assertTrue(len(errs) == 1 && errs[0] == c.err, fmt.Sprintf("%d: expected error %v, got %v", c.policy, c.err, errs), t)
+			} else {
+				assertTrue(len(errs) == 0, fmt.Sprintf("%d: expected no error, got %v", c.policy, errs), t)
+			}
+		}
+		srv.Close()
+		ms.Close()
+	}
+}
+
+func TestSessionNotRecreated(t *testing.T) {
+	ms := NewMemoryStore(10)
+	defer ms.Close()
+	// The plain store is checked with Get before the session is saved
+	stores := []SessionStore{ms, struct{ SessionStore }{ms}}
+	for i, st := range stores {
+		opts := NewSessionOptions(st, secret)
+		var errs []error
+		opts.OnError = func(w http.ResponseWriter, r *http.Request, err error) bool {
+			errs = append(errs, err)
+			return false
+		}
+		var ck *http.Cookie
+		var srv *httptest.Server
+		srv = setupTestOpts(func(w http.ResponseWriter, r *http.Request) {
+			ssn, _ := GetSession(w)
+			switch r.URL.Path {
+			case "/destroy", "/regenerate":
+				// A concurrent request destroys or regenerates the session while this
+				// one runs
+				ssn.Set("a", true)
+				doRequestWithCookie(srv.URL+"/concurrent"+r.URL.Path, ck)
+			case "/concurrent/destroy":
+				ssn.Destroy()
+			case "/concurrent/regenerate":
+				ssn.Regenerate()
+			}
+			w.Write([]byte(ssn.ID()))
+		}, opts)
+
+		res, _ := doRequestWithCookie(srv.URL, nil)
+		ck = res.Cookies()[0]
+		doRequestWithCookie(srv.URL+"/destroy", ck)
+		assertTrue(ms.Len() == 0, fmt.Sprintf("%d: expected destroyed session not to be saved again, got %d sessions", i, ms.Len()), t)
+		assertTrue(len(errs) == 1 && errs[0] == ErrSessionGone, fmt.Sprintf("%d: expected error %v, got %v", i, ErrSessionGone, errs), t)
+
+		errs = nil
+		res, oldID := doRequestWithCookie(srv.URL, nil)
+		ck = res.Cookies()[0]
+		doRequestWithCookie(srv.URL+"/regenerate", ck)
+		old, _ := ms.Get(oldID)
+		assertTrue(old == nil, fmt.Sprintf("%d: expected regenerated session ID not to be saved again", i), t)
+		assertTrue(ms.Len() == 1, fmt.Sprintf("%d: expected 1 session, got %d", i, ms.Len()), t)
+		assertTrue(len(errs) == 1 && errs[0] == ErrSessionGone, fmt.Sprintf("%d: expected error %v, got %v", i, ErrSessionGone, errs), t)
+		srv.Close()
+		ms.Clear()
+	}
+}
+
+func TestSessionIdleTimeoutReadOnly(t *testing.T) {
+	ms := NewMemoryStore(10)
+	defer ms.Close()
+	opts := NewSessionOptions(ms, secret)
+	opts.IdleTimeout = time.Hour
+	opts.ConflictPolicy = ConflictFail
+	var errs []error
+	opts.OnError = func(w http.ResponseWriter, r *http.Request, err error) bool {
+		errs = append(errs, err)
+		return false
+	}
+	var ck *http.Cookie
+	var srv *httptest.Server
+	srv = setupTestOpts(func(w http.ResponseWriter, r *http.Request) {
+		ssn, _ := GetSession(w)
+		switch r.URL.Path {
+		case "/write", "/destroy":
+			// A concurrent request changes the session while this read-only one runs
+			doRequestWithCookie(srv.URL+"/concurrent"+r.URL.Path, ck)
+		case "/concurrent/write":
+			ssn.Set("a", true)
+		case "/concurrent/destroy":
+			ssn.Destroy()
+		}
+		w.Write([]byte(ssn.ID()))
+	}, opts)
+	defer srv.Close()
+
+	res, id := doRequestWithCookie(srv.URL, nil)
+	ck = res.Cookies()[0]
+	ssn, _ := ms.Get(id)
+	la := ssn.LastAccess()
+	time.Sleep(10 * time.Millisecond)
+	doRequestWithCookie(srv.URL, ck)
+	ssn, _ = ms.Get(id)
+	assertTrue(ssn.LastAccess().After(la), "expected the last access time to be saved", t)
+
+	doRequestWithCookie(srv.URL+"/write", ck)
+	ssn, _ = ms.Get(id)
+	assertTrue(ssn != nil && ssn.Get("a") == true, "expected the concurrent update to be kept", t)
+	doRequestWithCookie(srv.URL+"/destroy", ck)
+	assertTrue(ms.Len() == 0, fmt.Sprintf("expected destroyed session not to be saved again, got %d sessions", ms.Len()), t)
+	assertTrue(len(errs) == 0, fmt.Sprintf("expected no error, got %v", errs), t)
+}
+
+func TestSessionChangedAfterSent(t *testing.T) {
+	ms := NewMemoryStore(10)
+	defer ms.Close()
+	opts := NewSessionOptions(ms, secret)
+	var errs []error
+	srv := setupTestOpts(func(w http.ResponseWriter, r *http.Request) {
+		ssn, _ := GetSession(w)
+		id := ssn.ID()
+		w.Write([]byte(id))
+		switch r.URL.Path {
+		case "/regenerate":
+			errs = append(errs, ssn.Regenerate())
+			if ssn.ID() != id {
+				errs = append(errs, errors.New("expected the session ID not to change"))
+			}
+		case "/destroy":
+			errs = append(errs, ssn.Destroy())
+		}
+	}, opts)
+	defer srv.Close()
+
+	res, id := doRequestWithCookie(srv.URL, nil)
+	ck := res.Cookies()[0]
+	res, _ = doRequestWithCookie(srv.URL+"/regenerate", ck)
+	assertTrue(len(errs) == 1 && errs[0] == ErrSessionSent, fmt.Sprintf("expected error %v, got %v", ErrSessionSent, errs), t)
+	assertTrue(len(res.Cookies()) == 0, fmt.Sprintf("expected no cookie, got %d", len(res.Cookies())), t)
+	ssn, _ := ms.Get(id)
+	assertTrue(ssn != nil, "expected the session ID to be kept in the store", t)
+
+	// The session is still deleted
+	errs = nil
+	doRequestWithCookie(srv.URL+"/destroy", ck)
+	assertTrue(len(errs) == 1 && errs[0] == ErrSessionSent, fmt.Sprintf("expected error %v, got %v", ErrSessionSent, errs), t)
+	assertTrue(ms.Len() == 0, fmt.Sprintf("expected destroyed session to be deleted, got %d sessions", ms.Len()), t)
+}
+
+func TestSessionPanicIfNoMerge(t *testing.T) {
+	defer assertPanic(t)
+	ms := NewMemoryStore(1)
+	defer ms.Close()
+	opts := NewSessionOptions(ms, secret)
+	opts.ConflictPolicy = ConflictMerge
+	SessionHandler(http.NotFoundHandler(), opts)
+}
+
+func doRequestWithHeader(u, name, val string) (*http.Response, string) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		panic(err)
+	}
+	if val != "" {
+		req.Header.Set(name, val)
+	}
+	res, err := new(http.Client).Do(req)
+	if err != nil {
+		panic(err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		panic(err)
+	}
+	return res, string(b)
+}
+
+func TestSessionTransports(t *testing.T) {
+	ms := NewMemoryStore(10)
+	defer ms.Close()
+	opts := NewSessionOptions(ms, secret)
+	opts.Transports = []SessionTransport{TransportHeader, TransportBearer, TransportCookie}
+	s := setupTestOpts(func(w http.ResponseWriter, r *http.Request) {
+		ssn, _ := GetSession(w)
+		if r.URL.Path == "/destroy" {
+			ssn.Destroy()
+			w.Write([]byte("ok"))
+			return
+		}
+		ssn.Set("cnt", fmt.Sprint(ssn.Get("cnt"))+"+")
+		w.Write([]byte(ssn.Get("cnt").(string)))
+	}, opts)
+	defer s.Close()
+
+	// A new session is sent with all transports
+	res, body := doRequestWithHeader(s.URL, "", "")
+	assertTrue(body == "<nil>+", fmt.Sprintf("expected body to be '<nil>+', got %s", body), t)
+	tok := res.Header.Get(defaultTokenHeader)
+	assertTrue(tok != "", "expected a session token header", t)
+	assertTrue(len(res.Cookies()) == 1, fmt.Sprintf("expected response to have 1 cookie, got %d", len(res.Cookies())), t)
+	ck := res.Cookies()[0]
+
+	// The token header, then the bearer token, share the session with the cookie
+	res, body = doRequestWithHeader(s.URL, defaultTokenHeader, tok)
+	assertTrue(body == "<nil>++", fmt.Sprintf("expected body to be '<nil>++', got %s", body), t)
+	assertTrue(len(res.Cookies()) == 0, fmt.Sprintf("expected response to have no cookie, got %d", len(res.Cookies())), t)
+	res, body = doRequestWithHeader(s.URL, "Authorization", "Bearer "+tok)
+	assertTrue(body == "<nil>+++", fmt.Sprintf("expected body to be '<nil>+++', got %s", body), t)
+	_, body = doRequestWithCookie(s.URL, ck)
+	assertTrue(body == "<nil>++++", fmt.Sprintf("expected body to be '<nil>++++', got %s", body), t)
+
+	// The header is preferred over the cookie
+	req, _ := http.NewRequest("GET", s.URL, nil)
+	req.AddCookie(ck)
+	req.Header.Set(defaultTokenHeader, "invalid")
+	res, err := new(http.Client).Do(req)
+	if err != nil {
+		panic(err)
+	}
+	res.Body.Close()
+	assertTrue(len(res.Cookies()) == 0, fmt.Sprintf("expected response to have no cookie, got %d", len(res.Cookies())), t)
+	assertTrue(res.Header.Get(defaultTokenHeader) != "", "expected a new session token header", t)
+
+	// Destroy clears the token
+	res, _ = doRequestWithHeader(s.URL+"/destroy", defaultTokenHeader, tok)
+	vals, ok := res.Header[defaultTokenHeader]
+	assertTrue(ok && len(vals) == 1 && vals[0] == "", fmt.Sprintf("expected an empty session token header, got %v", vals), t)
+	_, body = doRequestWithHeader(s.URL, defaultTokenHeader, tok)
+	assertTrue(body == "<nil>+", fmt.Sprintf("expected body to be '<nil>+', got %s", body), t)
+}
+
+func TestSessionPanicIfInvalidTransport(t *testing.T) {
+	defer assertPanic(t)
+	ms := NewMemoryStore(1)
+	defer ms.Close()
+	opts := NewSessionOptions(ms, secret)
+	opts.Transports = []SessionTransport{TransportBearer + 1}
+	SessionHandler(http.NotFoundHandler(), opts)
+}
+
+func TestSessionCookieTemplate(t *testing.T) {
+	cases := []struct {
+		ck  http.Cookie
+		err string
+	}{
+		{http.Cookie{Name: "sid", SameSite: http.SameSiteStrictMode}, ""},
+		{http.Cookie{Name: "sid", SameSite: http.SameSiteNoneMode}, "SameSite=None requires Secure"},
+		{http.Cookie{Name: "sid", SameSite: http.SameSiteNoneMode, Secure: true}, ""},
+		{http.Cookie{Name: "sid", SameSite: 42}, "unknown SameSite mode 42"},
+		{http.Cookie{Name: "__Secure-sid"}, `cookie "__Secure-sid" requires Secure`},
+		{http.Cookie{Name: "__Secure-sid", Secure: true, Domain: "example.com", Path: "/a"}, ""},
+		{http.Cookie{Name: "__Host-sid", Secure: true}, ""},
+		{http.Cookie{Name: "__host-sid"}, `cookie "__host-sid" requires Secure`},
+		{http.Cookie{Name: "__Host-sid", Secure: true, Domain: "example.com"}, `cookie "__Host-sid" must not have a Domain, got "example.com"`},
+		{http.Cookie{Name: "__Host-sid", Secure: true, Path: "/a"}, `cookie "__Host-sid" requires the Path "/", got "/a"`},
+	}
+	for i, c := range cases {
+		func() {
+			defer func() {
+				var msg string
+				if e := recover(); e != nil {
+					err, ok := e.(error)
+					assertTrue(ok && errors.Is(err, ErrInvalidCookie), fmt.Sprintf("%d: expected ErrInvalidCookie, got %v", i, e), t)
+					msg = fmt.Sprint(e)
+				}
+				ex := c.err
+				if ex != "" {
+					ex = ErrInvalidCookie.Error() + " : " + ex
+				}
+				assertTrue(msg == ex, fmt.Sprintf("%d: expected error '%s', got '%s'", i, ex, msg), t)
+			}()
+			ms := NewMemoryStore(1)
+			defer ms.Close()
+			opts := NewSessionOptions(ms, secret)
+			opts.CookieTemplate = c.ck
+			SessionHandler(http.NotFoundHandler(), opts)
+		}()
+	}
+}
+
+func TestSessionSameSite(t *testing.T) {
+	ms := NewMemoryStore(1)
+	defer ms.Close()
+	opts := NewSessionOptions(ms, secret)
+	opts.CookieTemplate.SameSite = http.SameSiteLaxMode
+	s := setupTestOpts(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}, opts)
+	defer s.Close()
+
+	res := doRequest(s.URL, true)
+	assertStatus(http.StatusOK, res.StatusCode, t)
+	ck := res.Header.Get("Set-Cookie")
+	assertTrue(strings.Contains(ck, "SameSite=Lax"), fmt.Sprintf("expected cookie to be SameSite=Lax, got %s", ck), t)
+}
@@ -0,0 +1,330 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const defaultSQLTableName = "ghost_sessions"
+
+var (
+	ErrNoDB             = errors.New("sql store database is missing")
+	ErrInvalidTableName = errors.New("invalid sql store table name")
+
+	// Valid table names, optionally qualified with the schema
+	rxTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+)
+
+// SQLDialect defines the parts of the SQL statements that differ between databases.
+// The table has three columns: id (the session ID, primary key), data (the encoded
+// session) and expires (the Unix time in milliseconds of the expiration of the
+// session, indexed).
+type SQLDialect interface {
+	Placeholder(n int) string          // Get the placeholder of the nth (1-based) argument of a statement
+	Upsert(table string) string        // Insert or update the id, data and expires arguments, in that order
+	CreateTable(table string) []string // Create the table and the index on the expires column
+}
+
+// Dialect for PostgreSQL (9.5 or later).
+type PostgresDialect struct{}
+
+func (this PostgresDialect) Placeholder(n int) string {
+	return fmt.Sprintf("$%d", n)
+}
+
+func (this PostgresDialect) Upsert(table string) string {
+	return fmt.Sprintf(`INSERT INTO %s (id, data, expires) VALUES ($1, $2, $3)
+ON CONFLICT (id) DO UPDATE SET data = EXCLUDED.data, expires = EXCLUDED.expires`, table)
+}
+
+func (this PostgresDialect) CreateTable(table string) []string {
+	return []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (id VARCHAR(255) PRIMARY KEY, data BYTEA NOT NULL, expires BIGINT NOT NULL)`, table),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s_expires_idx ON %[2]s (expires)`, indexPrefix(table), table),
+	}
+}
+
+// Dialect for MySQL.
+type MySQLDialect struct{}
+
+func (this MySQLDialect) Placeholder(n int) string {
+	return "?"
+}
+
+func (this MySQLDialect) Upsert(table string) string {
+	return fmt.Sprintf(`INSERT INTO %s (id, data, expires) VALUES (?, ?, ?)
+ON DUPLICATE KEY UPDATE data = VALUES(data), expires = VALUES(expires)`, table)
+}
+
+func (this MySQLDialect) CreateTable(table string) []string {
+	return []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (id VARCHAR(255) PRIMARY KEY, data LONGBLOB NOT NULL, expires BIGINT NOT NULL, INDEX %s_expires_idx (expires))`, table, indexPrefix(table)),
+	}
+}
+
+// Dialect for SQLite.
+type SQLiteDialect struct{}
+
+func (this SQLiteDialect) Placeholder(n int) string {
+	return "?"
+}
+
+func (this SQLiteDialect) Upsert(table string) string {
+	return fmt.Sprintf(`INSERT OR REPLACE INTO %s (id, data, expires) VALUES (?, ?, ?)`, table)
+}
+
+func (this SQLiteDialect) CreateTable(table string) []string {
+	return []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (id VARCHAR(255) PRIMARY KEY, data BLOB NOT NULL, expires INTEGER NOT NULL)`, table),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s_expires_idx ON %[2]s (expires)`, indexPrefix(table), table),
+	}
+}
+
+type SQLStoreOptions struct {
+	DB                   *sql.DB       // Required, the database of the sessions table
+	Dialect              SQLDialect    // Defaults to PostgresDialect
+	TableName            string        // Defaults to "ghost_sessions"
+	BrowserSessServerTTL time.Duration // Defaults to 2 days
+	Codec                SessionCodec  // Encoding of the sessions, defaults to JSONCodec
+}
+
+// database/sql implementation of a session store. The table can be created
+// with CreateTable, and expired sessions must be deleted by calling Purge
+// periodically (they are ignored by Get and Len).
+type SQLStore struct {
+	opts *SQLStoreOptions
+
+	// The statements, built once when the store is created
+	createQ  []string
+	getQ     string
+	setQ     string
+	replaceQ string
+	touchQ   string
+	delQ     string
+	removeQ  string
+	clearQ   string
+	lenQ     string
+	purgeQ   string
+}
+
+// Create a sql session store with the specified options.
+func NewSQLStore(opts *SQLStoreOptions) (*SQLStore, error) {
+	if opts.DB == nil {
+		return nil, ErrNoDB
+	}
+	if opts.Dialect == nil {
+		opts.Dialect = PostgresDialect{}
+	}
+	if opts.TableName == "" {
+		opts.TableName = defaultSQLTableName
+	}
+	if !rxTableName.MatchString(opts.TableName) {
+		return nil, ErrInvalidTableName
+	}
+	d, tbl := opts.Dialect, opts.TableName
+	return &SQLStore{
+		opts:    opts,
+		createQ: d.CreateTable(tbl),
+		getQ:    fmt.Sprintf("SELECT data FROM %s WHERE id = %s AND expires > %s", tbl, d.Placeholder(1), d.Placeholder(2)),
+		setQ:    d.Upsert(tbl),
+		replaceQ: fmt.Sprintf("UPDATE %s SET data = %s, expires = %s WHERE id = %s AND expires > %s",
+			tbl, d.Placeholder(1), d.Placeholder(2), d.Placeholder(3), d.Placeholder(4)),
+		touchQ: fmt.Sprintf("UPDATE %s SET data = %s, expires = %s WHERE id = %s AND data = %s",
+			tbl, d.Placeholder(1), d.Placeholder(2), d.Placeholder(3), d.Placeholder(4)),
+		delQ:    fmt.Sprintf("DELETE FROM %s WHERE id = %s", tbl, d.Placeholder(1)),
+		removeQ: fmt.Sprintf("DELETE FROM %s WHERE id = %s AND expires > %s", tbl, d.Placeholder(1), d.Placeholder(2)),
+		clearQ:  fmt.Sprintf("DELETE FROM %s", tbl),
+		lenQ:    fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE expires > %s", tbl, d.Placeholder(1)),
+		purgeQ:  fmt.Sprintf("DELETE FROM %s WHERE expires <= %s", tbl, d.Placeholder(1)),
+	}, nil
+}
+
+// Create the sessions table and its index, if they do not exist.
+func (this *SQLStore) CreateTable() error {
+	for _, q := range this.createQ {
+		if _, err := this.opts.DB.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the session from the store.
+func (this *SQLStore) Get(id string) (*Session, error) {
+	return this.GetContext(context.Background(), id)
+}
+
+// Get the session from the store, the query is cancelled when the context is done.
+func (this *SQLStore) GetContext(ctx context.Context, id string) (*Session, error) {
+	var b []byte
+	err := this.opts.DB.QueryRowContext(ctx, this.getQ, id, unixMilli(time.Now())).Scan(&b)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return getCodec(this.opts.Codec).Decode(b)
+}
+
+// Save the session into the store.
+func (this *SQLStore) Set(sess *Session) error {
+	return this.SetContext(context.Background(), sess)
+}
+
+// Save the session into the store, the statement is cancelled when the context is done.
+func (this *SQLStore) SetContext(ctx context.Context, sess *Session) error {
+	b, err := getCodec(this.opts.Codec).Encode(sess)
+	if err != nil {
+		return err
+	}
+	_, err = this.opts.DB.ExecContext(ctx, this.setQ, sess.ID(), b, this.getExpires(sess))
+	return err
+}
+
+// Save the session into the store if id is in the store (and not expired), and
+// delete id if it is not the ID of the session, in a transaction.
+func (this *SQLStore) Replace(sess *Session, id string) (bool, error) {
+	return this.ReplaceContext(context.Background(), sess, id)
+}
+
+// Save the session into the store if id is in the store, the statements are cancelled
+// when the context is done.
+func (this *SQLStore) ReplaceContext(ctx context.Context, sess *Session, id string) (bool, error) {
+	b, err := getCodec(this.opts.Codec).Encode(sess)
+	if err != nil {
+		return false, err
+	}
+	now := unixMilli(time.Now())
+	if id == sess.ID() {
+		res, err := this.opts.DB.ExecContext(ctx, this.replaceQ, b, this.getExpires(sess), id, now)
+		if err != nil {
+			return false, err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 1 {
+			return n == 1, err
+		}
+		// MySQL reports 0 rows for an update with the same values (unless the
+		// connection sets CLIENT_FOUND_ROWS), check if the session is in the store
+		var data []byte
+		err = this.opts.DB.QueryRowContext(ctx, this.getQ, id, now).Scan(&data)
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	tx, err := this.opts.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, this.removeQ, id, now)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return false, err
+	}
+	if _, err = tx.ExecContext(ctx, this.setQ, sess.ID(), b, this.getExpires(sess)); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// Reset the expiration and save the last access time of the session, without saving
+// its content. The stored session is only updated if it did not change since it was
+// read, so that a session saved or deleted concurrently is not touched.
+func (this *SQLStore) Touch(sess *Session) error {
+	return this.TouchContext(context.Background(), sess)
+}
+
+// Reset the expiration and save the last access time of the session, the statements
+// are cancelled when the context is done.
+func (this *SQLStore) TouchContext(ctx context.Context, sess *Session) error {
+	c := getCodec(this.opts.Codec)
+	var b []byte
+	err := this.opts.DB.QueryRowContext(ctx, this.getQ, sess.ID(), unixMilli(time.Now())).Scan(&b)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// Not in the store, it is not created again
+			return nil
+		}
+		return err
+	}
+	stored, err := c.Decode(b)
+	if err != nil {
+		return err
+	}
+	stored.internalSession.LastAccess = sess.internalSession.LastAccess
+	nb, err := c.Encode(stored)
+	if err != nil {
+		return err
+	}
+	_, err = this.opts.DB.ExecContext(ctx, this.touchQ, nb, this.getExpires(sess), sess.ID(), b)
+	return err
+}
+
+// Delete the session from the store.
+func (this *SQLStore) Delete(id string) error {
+	return this.DeleteContext(context.Background(), id)
+}
+
+// Delete the session from the store, the statement is cancelled when the context is done.
+func (this *SQLStore) DeleteContext(ctx context.Context, id string) error {
+	_, err := this.opts.DB.ExecContext(ctx, this.delQ, id)
+	return err
+}
+
+// Clear all sessions from the store.
+func (this *SQLStore) Clear() error {
+	_, err := this.opts.DB.Exec(this.clearQ)
+	return err
+}
+
+// Get the number of sessions in the store, not counting the expired sessions.
+// Returns -1 if the count fails.
+func (this *SQLStore) Len() int {
+	return this.LenContext(context.Background())
+}
+
+// Get the number of sessions in the store, the query is cancelled when the context
+// is done. Returns -1 if the count fails.
+func (this *SQLStore) LenContext(ctx context.Context) int {
+	var n int
+	err := this.opts.DB.QueryRowContext(ctx, this.lenQ, unixMilli(time.Now())).Scan(&n)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// Delete the expired sessions from the store, and return the number of sessions
+// deleted. It should be called periodically.
+func (this *SQLStore) Purge() (int64, error) {
+	res, err := this.opts.DB.Exec(this.purgeQ, unixMilli(time.Now()))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Get the Unix time in milliseconds of the expiration of the session.
+func (this *SQLStore) getExpires(sess *Session) int64 {
+	return unixMilli(time.Now().Add(sessionTTL(sess, this.opts.BrowserSessServerTTL)))
+}
+
+// Get the Unix time in milliseconds.
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// Get the prefix of the index name for the table, without the schema.
+func indexPrefix(table string) string {
+	return table[strings.LastIndex(table, ".")+1:]
+}
@@ -0,0 +1,310 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Fake in-process database/sql driver, that understands only the statements
+// of the SQLStore. Each DSN is a separate database with a single table.
+type fakeSQLDriver struct {
+	l   sync.Mutex
+	dbs map[string]*fakeSQLDB
+}
+
+type fakeSQLRow struct {
+	data    []byte
+	expires int64
+}
+
+type fakeSQLDB struct {
+	l       sync.Mutex
+	rows    map[string]fakeSQLRow
+	queries []string
+	// Report 0 rows for the updates, as MySQL does when the values are the same
+	noUpdateRows bool
+}
+
+type fakeSQLConn struct {
+	db *fakeSQLDB
+}
+
+type fakeSQLStmt struct {
+	db *fakeSQLDB
+	q  string
+}
+
+type fakeSQLRows struct {
+	cols []string
+	vals [][]driver.Value
+}
+
+var fakeDriver = &fakeSQLDriver{dbs: make(map[string]*fakeSQLDB)}
+
+func init() {
+	sql.Register("ghostfake", fakeDriver)
+}
+
+func (this *fakeSQLDriver) Open(dsn string) (driver.Conn, error) {
+	this.l.Lock()
+	defer this.l.Unlock()
+	db, ok := this.dbs[dsn]
+	if !ok {
+		db = &fakeSQLDB{rows: make(map[string]fakeSQLRow), noUpdateRows: strings.HasSuffix(dsn, "-noupdaterows")}
+		this.dbs[dsn] = db
+	}
+	return &fakeSQLConn{db}, nil
+}
+
+func (this *fakeSQLConn) Prepare(q string) (driver.Stmt, error) {
+	return &fakeSQLStmt{this.db, q}, nil
+}
+
+func (this *fakeSQLConn) Close() error {
+	return nil
+}
+
+// Transactions are accepted, but the statements are applied immediately and
+// cannot be rolled back.
+func (this *fakeSQLConn) Begin() (driver.Tx, error) {
+	return fakeSQLTx{}, nil
+}
+
+type fakeSQLTx struct{}
+
+func (this fakeSQLTx) Commit() error {
+	return nil
+}
+
+func (this fakeSQLTx) Rollback() error {
+	return nil
+}
+
+func (this *fakeSQLStmt) Close() error {
+	return nil
+}
+
+func (this *fakeSQLStmt) NumInput() int {
+	return -1
+}
+
+func (this *fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	this.db.l.Lock()
+	defer this.db.l.Unlock()
+	this.db.queries = append(this.db.queries, this.q)
+
+	var n int64
+	switch q := this.q; {
+	case strings.HasPrefix(q, "CREATE"):
+	case strings.HasPrefix(q, "INSERT"):
+		this.db.rows[args[0].(string)] = fakeSQLRow{args[1].([]byte), args[2].(int64)}
+		n = 1
+	case strings.HasPrefix(q, "UPDATE") && strings.Contains(q, "AND data ="):
+		id := args[2].(string)
+		if r, ok := this.db.rows[id]; ok && bytes.Equal(r.data, args[3].([]byte)) {
+			this.db.rows[id] = fakeSQLRow{args[0].([]byte), args[1].(int64)}
+			n = 1
+		}
+	case strings.HasPrefix(q, "UPDATE"):
+		id := args[2].(string)
+		if r, ok := this.db.rows[id]; ok && r.expires > args[3].(int64) {
+			this.db.rows[id] = fakeSQLRow{args[0].([]byte), args[1].(int64)}
+			if !this.db.noUpdateRows {
+				n = 1
+			}
+		}
+	case strings.Contains(q, "WHERE id =") && strings.Contains(q, "AND expires >"):
+		if r, ok := this.db.rows[args[0].(string)]; ok && r.expires > args[1].(int64) {
+			delete(this.db.rows, args[0].(string))
+			n = 1
+		}
+	case strings.Contains(q, "WHERE id ="):
+		if _, ok := this.db.rows[args[0].(string)]; ok {
+			delete(this.db.rows, args[0].(string))
+			n = 1
+		}
+	case strings.Contains(q, "WHERE expires <="):
+		for id, r := range this.db.rows {
+			if r.expires <= args[0].(int64) {
+				delete(this.db.rows, id)
+				n++
+			}
+		}
+	case strings.HasPrefix(q, "DELETE"):
+		n = int64(len(this.db.rows))
+		this.db.rows = make(map[string]fakeSQLRow)
+	default:
+		return nil, fmt.Errorf("unexpected statement: %s", q)
+	}
+	return driver.RowsAffected(n), nil
+}
+
+func (this *fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	this.db.l.Lock()
+	defer this.db.l.Unlock()
+	this.db.queries = append(this.db.queries, this.q)
+
+	switch q := this.q; {
+	case strings.HasPrefix(q, "SELECT data"):
+		rows := &fakeSQLRows{cols: []string{"data"}}
+		if r, ok := this.db.rows[args[0].(string)]; ok && r.expires > args[1].(int64) {
+			rows.vals = append(rows.vals, []driver.Value{r.data})
+		}
+		return rows, nil
+	case strings.HasPrefix(q, "SELECT COUNT(*)"):
+		var n int64
+		for _, r := range this.db.rows {
+			if r.expires > args[0].(int64) {
+				n++
+			}
+		}
+		return &fakeSQLRows{[]string{"count"}, [][]driver.Value{{n}}}, nil
+	}
+	return nil, fmt.Errorf("unexpected query: %s", this.q)
+}
+
+func (this *fakeSQLRows) Columns() []string {
+	return this.cols
+}
+
+func (this *fakeSQLRows) Close() error {
+	return nil
+}
+
+func (this *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(this.vals) == 0 {
+		return io.EOF
+	}
+	copy(dest, this.vals[0])
+	this.vals = this.vals[1:]
+	return nil
+}
+
+func newTestSQLStore(dsn string, d SQLDialect) (*SQLStore, *fakeSQLDB) {
+	db, err := sql.Open("ghostfake", dsn)
+	if err != nil {
+		panic(err)
+	}
+	ss, err := NewSQLStore(&SQLStoreOptions{
+		DB:      db,
+		Dialect: d,
+	})
+	if err != nil {
+		panic(err)
+	}
+	if err = ss.CreateTable(); err != nil {
+		panic(err)
+	}
+	return ss, fakeDriver.dbs[dsn]
+}
+
+func TestSQLStoreSession(t *testing.T) {
+	dialects := map[string]SQLDialect{
+		"postgres": PostgresDialect{},
+		"mysql":    MySQLDialect{},
+		"sqlite":   SQLiteDialect{},
+	}
+	for k, d := range dialects {
+		t.Logf("testing session with %s dialect\n", k)
+		store, _ = newTestSQLStore("session-"+k, d)
+		t.Log("SessionExists")
+		testSessionExists(t)
+		t.Log("SessionPersists")
+		testSessionPersists(t)
+		t.Log("SessionExpires")
+		testSessionExpires(t)
+		t.Log("SessionBeforeExpires")
+		testSessionBeforeExpires(t)
+		t.Log("SessionSlidingExpiration")
+		testSessionSlidingExpiration(t)
+		t.Log("SessionRegenerate")
+		testSessionRegenerate(t)
+		t.Log("SessionDestroy")
+		testSessionDestroy(t)
+	}
+}
+
+func TestSQLStorePurge(t *testing.T) {
+	ss, _ := newTestSQLStore("purge", nil)
+	ssn := newSession(0)
+	ssn.internalSession.MaxAge = 10 * time.Millisecond
+	ss.Set(ssn)
+	ss.Set(newSession(0))
+	ss.Set(newSession(0))
+	assertTrue(ss.Len() == 3, fmt.Sprintf("expected store to have 3 sessions, got %d", ss.Len()), t)
+	time.Sleep(20 * time.Millisecond)
+	assertTrue(ss.Len() == 2, fmt.Sprintf("expected store to have 2 sessions, got %d", ss.Len()), t)
+
+	n, err := ss.Purge()
+	if err != nil {
+		panic(err)
+	}
+	assertTrue(n == 1, fmt.Sprintf("expected 1 session to be purged, got %d", n), t)
+	if err = ss.Clear(); err != nil {
+		panic(err)
+	}
+	assertTrue(ss.Len() == 0, fmt.Sprintf("expected store to have 0 session, got %d", ss.Len()), t)
+}
+
+func TestSQLStoreReplaceNoUpdateRows(t *testing.T) {
+	ss, _ := newTestSQLStore("replace-noupdaterows", MySQLDialect{})
+	ssn := newSession(0)
+	ss.Set(ssn)
+	ssn.Set("foo", "bar")
+	ok, err := ss.Replace(ssn, ssn.ID())
+	assertTrue(ok && err == nil, fmt.Sprintf("expected session in the store to be replaced, got %t, %v", ok, err), t)
+	got, _ := ss.Get(ssn.ID())
+	assertTrue(got != nil && got.Get("foo") == "bar", fmt.Sprintf("expected the session to be saved, got %v", got), t)
+
+	missing := newSession(0)
+	ok, err = ss.Replace(missing, missing.ID())
+	assertTrue(!ok && err == nil, fmt.Sprintf("expected missing session not to be replaced, got %t, %v", ok, err), t)
+}
+
+func TestSQLStoreDialects(t *testing.T) {
+	cases := []struct {
+		d     SQLDialect
+		del   string
+		index string
+	}{
+		{PostgresDialect{}, "DELETE FROM app.sess WHERE id = $1", "CREATE INDEX IF NOT EXISTS sess_expires_idx ON app.sess (expires)"},
+		{MySQLDialect{}, "DELETE FROM app.sess WHERE id = ?", ""},
+		{SQLiteDialect{}, "DELETE FROM app.sess WHERE id = ?", "CREATE INDEX IF NOT EXISTS sess_expires_idx ON app.sess (expires)"},
+	}
+	for _, c := range cases {
+		db, err := sql.Open("ghostfake", "dialects")
+		if err != nil {
+			panic(err)
+		}
+		ss, err := NewSQLStore(&SQLStoreOptions{DB: db, Dialect: c.d, TableName: "app.sess"})
+		if err != nil {
+			panic(err)
+		}
+		assertTrue(ss.delQ == c.del, fmt.Sprintf("expected delete statement to be %q, got %q", c.del, ss.delQ), t)
+		if c.index != "" {
+			assertTrue(ss.createQ[1] == c.index, fmt.Sprintf("expected index statement to be %q, got %q", c.index, ss.createQ[1]), t)
+		} else {
+			assertTrue(strings.Contains(ss.createQ[0], "INDEX sess_expires_idx (expires)"), fmt.Sprintf("expected create table statement to have an index, got %q", ss.createQ[0]), t)
+		}
+	}
+}
+
+func TestSQLStoreInvalidTableName(t *testing.T) {
+	db, err := sql.Open("ghostfake", "invalid")
+	if err != nil {
+		panic(err)
+	}
+	for _, nm := range []string{"sess; DROP TABLE users", "1sess", "a.b.c"} {
+		_, err := NewSQLStore(&SQLStoreOptions{DB: db, TableName: nm})
+		assertTrue(err == ErrInvalidTableName, fmt.Sprintf("expected error %s for table %q, got %v", ErrInvalidTableName, nm, err), t)
+	}
+	_, err = NewSQLStore(&SQLStoreOptions{})
+	assertTrue(err == ErrNoDB, fmt.Sprintf("expected error %s, got %v", ErrNoDB, err), t)
+}
@@ -1,10 +1,19 @@
 package handlers
 
 import (
+	"container/list"
+	"context"
+	"errors"
+	"sort"
 	"sync"
 	"time"
 )
 
+// ErrCompareAndSetUnsupported is returned by CompareAndSet when the store wraps a
+// store that does not support optimistic concurrency. The SessionHandler then saves
+// the session as if the store did not implement SessionCompareAndSetter.
+var ErrCompareAndSetUnsupported = errors.New("session store does not support compare and set")
+
 // SessionStore interface, must be implemented by any store to be used
 // for session storage.
 type SessionStore interface {
@@ -15,55 +24,243 @@ type SessionStore interface {
 	Len() int                        // Get the number of sessions in the store
 }
 
-// In-memory implementation of a session store. Not recommended for production
-// use.
+// SessionToucher can be implemented by a SessionStore that is able to refresh
+// the expiration and the last access time of a session without saving its whole
+// content again. It is used for sliding expiration and idle timeouts, when the
+// session did not change during the request. A session that is not in the store
+// (i.e. destroyed by a concurrent request) must not be created. Stores that do not
+// implement it get the session saved again, if it is still in the store.
+type SessionToucher interface {
+	Touch(sess *Session) error // Reset the expiration and save the last access time of the session
+}
+
+// ContextSessionStore can be implemented by a SessionStore that supports the
+// cancellation of its operations. The SessionHandler prefers these methods, with
+// the context of the request, so that a slow store call is abandoned when the
+// client goes away or the deadline of the request is exceeded.
+type ContextSessionStore interface {
+	SessionStore
+	GetContext(ctx context.Context, id string) (*Session, error) // Get the session from the store
+	SetContext(ctx context.Context, sess *Session) error         // Save the session in the store
+	DeleteContext(ctx context.Context, id string) error          // Delete the session from the store
+}
+
+// SessionCompareAndSetter can be implemented by a SessionStore that supports
+// optimistic concurrency. The session is saved only if the version of the session
+// currently in the store is the specified version (0 if it is not in the store),
+// otherwise it is not saved and false is returned. It is used by the SessionHandler
+// unless the ConflictPolicy is ConflictLastWriteWins.
+type SessionCompareAndSetter interface {
+	CompareAndSet(sess *Session, version int64) (bool, error) // Save the session if its stored version is version
+}
+
+// SessionReplacer can be implemented by a SessionStore that can save a session only
+// if it is still in the store, atomically. It is used by the SessionHandler to save a
+// session that was loaded from the store, so that a session deleted by a concurrent
+// request (i.e. destroyed) is not created again. If id is not the ID of the session
+// (the ID was regenerated), the session is moved: id is deleted and the session is
+// saved under its new ID. False is returned if id is not in the store. Stores that do
+// not implement it are checked with Get before the session is saved.
+type SessionReplacer interface {
+	Replace(sess *Session, id string) (bool, error) // Save the session if id is in the store
+}
+
+// ContextSessionToucher is the version of SessionToucher that supports the
+// cancellation of its operation, it is preferred by the SessionHandler.
+type ContextSessionToucher interface {
+	TouchContext(ctx context.Context, sess *Session) error // Reset the expiration and save the last access time of the session
+}
+
+// ContextSessionCompareAndSetter is the version of SessionCompareAndSetter that
+// supports the cancellation of its operation, it is preferred by the SessionHandler.
+type ContextSessionCompareAndSetter interface {
+	CompareAndSetContext(ctx context.Context, sess *Session, version int64) (bool, error) // Save the session if its stored version is version
+}
+
+// ContextSessionReplacer is the version of SessionReplacer that supports the
+// cancellation of its operation, it is preferred by the SessionHandler.
+type ContextSessionReplacer interface {
+	ReplaceContext(ctx context.Context, sess *Session, id string) (bool, error) // Save the session if id is in the store
+}
+
+// SessionIndexer can be implemented by a SessionStore that indexes the sessions by
+// owner (i.e. the user name), so that all sessions of an owner can be listed and
+// deleted, for example after a password change. A regenerated session ID must be
+// associated again with its owner. A session ID may be associated before the session
+// is saved: OwnerSessions only lists the sessions in the store, while IsOwner checks
+// the association itself. The stores may drop the association if the session is
+// still not saved after a while.
+type SessionIndexer interface {
+	Associate(owner, id string) error             // Associate the session ID with the owner
+	IsOwner(owner, id string) (bool, error)       // Check if the session ID is associated with the owner
+	OwnerSessions(owner string) ([]string, error) // Get the IDs of the sessions of the owner
+	DeleteOwnerSessions(owner string) error       // Delete all sessions of the owner from the store
+}
+
+const (
+	defaultSweepInterval = time.Minute
+	defaultBrowserTTL    = 2 * 24 * time.Hour
+)
+
+// Options for the memory store.
+type MemoryStoreOptions struct {
+	Capacity      int           // Initial capacity of the store
+	MaxLen        int           // Max number of sessions, the least recently used are evicted, 0 means no limit
+	SweepInterval time.Duration // Interval between removals of expired sessions, defaults to 1 minute
+	Codec         SessionCodec  // Encoding of the sessions in snapshots, defaults to JSONCodec
+}
+
+// In-memory implementation of a session store. It is only suited for single-node
+// deployments, and sessions are lost when the process exits. It should be bounded
+// with a MaxLen in production use. A single background goroutine removes the expired
+// sessions, it is stopped by Close. Copies of the sessions are saved and returned, so
+// that concurrent requests do not share the same data map.
 type MemoryStore struct {
-	l    sync.RWMutex
-	m    map[string]*Session
-	capc int
+	l    sync.Mutex
+	opts MemoryStoreOptions
+	m    map[string]*list.Element
+	lru  *list.List // Most recently used at the front
+	// The session IDs by owner, and the owner by session ID
+	index  map[string]map[string]struct{}
+	owners map[string]string
+	// The time of association of the IDs not in the store when they were associated
+	unsaved map[string]time.Time
+	stop    chan struct{}
+	once    sync.Once
 }
 
-// Create a new memory store.
+// An entry of the memory store, with its expiration time. The ID is kept in the
+// entry because the ID of the session may change (see Session.Regenerate).
+type memoryEntry struct {
+	id   string
+	sess *Session
+	exp  time.Time
+}
+
+// Create a new memory store, with no limit on the number of sessions. It starts
+// the goroutine that removes the expired sessions, Close must be called to stop it.
 func NewMemoryStore(capc int) *MemoryStore {
-	m := &MemoryStore{}
-	m.capc = capc
+	return NewMemoryStoreWithOptions(&MemoryStoreOptions{Capacity: capc})
+}
+
+// Create a new memory store with the specified options. As with NewMemoryStore,
+// Close must be called to stop the goroutine that removes the expired sessions.
+func NewMemoryStoreWithOptions(opts *MemoryStoreOptions) *MemoryStore {
+	m := &MemoryStore{
+		opts: *opts,
+		stop: make(chan struct{}),
+	}
+	if m.opts.SweepInterval <= 0 {
+		m.opts.SweepInterval = defaultSweepInterval
+	}
 	m.newMap()
+	go m.sweep()
 	return m
 }
 
 // Get the number of sessions saved in the store.
 func (this *MemoryStore) Len() int {
+	this.l.Lock()
+	defer this.l.Unlock()
 	return len(this.m)
 }
 
 // Get the requested session from the store.
 func (this *MemoryStore) Get(id string) (*Session, error) {
-	this.l.RLock()
-	defer this.l.RUnlock()
-	return this.m[id], nil
+	this.l.Lock()
+	defer this.l.Unlock()
+	el, ok := this.m[id]
+	if !ok {
+		return nil, nil
+	}
+	ent := el.Value.(*memoryEntry)
+	if time.Now().After(ent.exp) {
+		// Expired, but not yet removed by the sweeper
+		this.remove(el)
+		return nil, nil
+	}
+	this.lru.MoveToFront(el)
+	return ent.sess.clone(), nil
 }
 
-// Save the session to the store.
+// Save the session to the store. If the store is full, the least recently
+// used session is evicted.
 func (this *MemoryStore) Set(sess *Session) error {
 	this.l.Lock()
 	defer this.l.Unlock()
-	this.m[sess.ID()] = sess
-	if sess.IsNew() {
-		// Since the memory store doesn't marshal to a string without the isNew, if it is left
-		// to true, it will stay true forever.
-		sess.isNew = false
-		// Expire in the given time. If the maxAge is 0 (which means browser-session lifetime),
-		// expire in a reasonable delay, 2 days. The weird case of a negative maxAge will
-		// cause the immediate Delete call.
-		wait := sess.MaxAge()
-		if wait == 0 {
-			wait = 2 * 24 * time.Hour
+	this.set(sess)
+	return nil
+}
+
+// Save the session to the store if the version of the stored session is the
+// specified version.
+func (this *MemoryStore) CompareAndSet(sess *Session, version int64) (bool, error) {
+	this.l.Lock()
+	defer this.l.Unlock()
+	var cur int64
+	if el, ok := this.m[sess.ID()]; ok {
+		ent := el.Value.(*memoryEntry)
+		if !time.Now().After(ent.exp) {
+			cur = ent.sess.Version()
 		}
-		go func() {
-			// Clear the session after the specified delay
-			<-time.After(wait)
-			this.Delete(sess.ID())
-		}()
+	}
+	if cur != version {
+		return false, nil
+	}
+	this.set(sess)
+	return true, nil
+}
+
+// Save the session to the store if id is in the store, and delete id if it is not
+// the ID of the session.
+func (this *MemoryStore) Replace(sess *Session, id string) (bool, error) {
+	this.l.Lock()
+	defer this.l.Unlock()
+	el, ok := this.m[id]
+	if !ok {
+		return false, nil
+	}
+	if time.Now().After(el.Value.(*memoryEntry).exp) {
+		this.remove(el)
+		return false, nil
+	}
+	if id != sess.ID() {
+		this.remove(el)
+	}
+	this.set(sess)
+	return true, nil
+}
+
+// Save a copy of the session to the store, evicting the least recently used
+// sessions if the store is full. The lock must be held by the caller.
+func (this *MemoryStore) set(sess *Session) {
+	// Since the memory store doesn't marshal to a string without the isNew, if it is left
+	// to true, it will stay true forever.
+	sess = sess.clone()
+	sess.isNew = false
+	exp := time.Now().Add(sessionTTL(sess, 0))
+	if el, ok := this.m[sess.ID()]; ok {
+		ent := el.Value.(*memoryEntry)
+		ent.sess, ent.exp = sess, exp
+		this.lru.MoveToFront(el)
+		return
+	}
+	this.m[sess.ID()] = this.lru.PushFront(&memoryEntry{sess.ID(), sess, exp})
+	for this.opts.MaxLen > 0 && this.lru.Len() > this.opts.MaxLen {
+		this.remove(this.lru.Back())
+	}
+}
+
+// Reset the expiration and save the last access time of the session, if it is
+// still in the store.
+func (this *MemoryStore) Touch(sess *Session) error {
+	this.l.Lock()
+	defer this.l.Unlock()
+	if el, ok := this.m[sess.ID()]; ok {
+		ent := el.Value.(*memoryEntry)
+		ent.exp = time.Now().Add(sessionTTL(sess, 0))
+		ent.sess.internalSession.LastAccess = sess.internalSession.LastAccess
+		this.lru.MoveToFront(el)
 	}
 	return nil
 }
@@ -72,7 +269,9 @@ func (this *MemoryStore) Set(sess *Session) error {
 func (this *MemoryStore) Delete(id string) error {
 	this.l.Lock()
 	defer this.l.Unlock()
-	delete(this.m, id)
+	if el, ok := this.m[id]; ok {
+		this.remove(el)
+	}
 	return nil
 }
 
@@ -84,7 +283,151 @@ func (this *MemoryStore) Clear() error {
 	return nil
 }
 
-// Re-create the internal map, dropping all existing sessions.
+// Associate the session ID with the owner. A session has only one owner, it is
+// removed from the sessions of its previous owner, if any. If the session is not in
+// the store, the association is removed by the sweeper if the session is still not
+// saved after a sweep interval.
+func (this *MemoryStore) Associate(owner, id string) error {
+	this.l.Lock()
+	defer this.l.Unlock()
+	this.unindex(id)
+	ids, ok := this.index[owner]
+	if !ok {
+		ids = make(map[string]struct{})
+		this.index[owner] = ids
+	}
+	ids[id] = struct{}{}
+	this.owners[id] = owner
+	if _, ok := this.m[id]; !ok {
+		this.unsaved[id] = time.Now()
+	}
+	return nil
+}
+
+// Check if the session ID is associated with the owner, whether the session is in
+// the store or not.
+func (this *MemoryStore) IsOwner(owner, id string) (bool, error) {
+	this.l.Lock()
+	defer this.l.Unlock()
+	_, ok := this.index[owner][id]
+	return ok, nil
+}
+
+// Get the IDs of the sessions of the owner that are in the store.
+func (this *MemoryStore) OwnerSessions(owner string) ([]string, error) {
+	this.l.Lock()
+	defer this.l.Unlock()
+	now := time.Now()
+	res := make([]string, 0, len(this.index[owner]))
+	for id := range this.index[owner] {
+		if el, ok := this.m[id]; ok && !now.After(el.Value.(*memoryEntry).exp) {
+			res = append(res, id)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// Delete all sessions of the owner from the store.
+func (this *MemoryStore) DeleteOwnerSessions(owner string) error {
+	this.l.Lock()
+	defer this.l.Unlock()
+	for id := range this.index[owner] {
+		if el, ok := this.m[id]; ok {
+			this.remove(el)
+		}
+		this.unindex(id)
+	}
+	return nil
+}
+
+// Stop the background goroutine that removes the expired sessions. The store
+// can still be used, but expired sessions are only removed when requested.
+func (this *MemoryStore) Close() error {
+	this.once.Do(func() {
+		close(this.stop)
+	})
+	return nil
+}
+
+// Remove the expired sessions at each sweep interval, until the store is closed.
+func (this *MemoryStore) sweep() {
+	t := time.NewTicker(this.opts.SweepInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-this.stop:
+			return
+		case now := <-t.C:
+			this.removeExpired(now)
+		}
+	}
+}
+
+// Remove the sessions that are expired at the specified time, and the associations
+// of the IDs that are still not saved a sweep interval after they were associated.
+func (this *MemoryStore) removeExpired(now time.Time) {
+	this.l.Lock()
+	defer this.l.Unlock()
+	for el := this.lru.Front(); el != nil; {
+		next := el.Next()
+		if now.After(el.Value.(*memoryEntry).exp) {
+			this.remove(el)
+		}
+		el = next
+	}
+	for id, at := range this.unsaved {
+		if _, ok := this.m[id]; ok {
+			delete(this.unsaved, id)
+		} else if now.Sub(at) >= this.opts.SweepInterval {
+			this.unindex(id)
+		}
+	}
+}
+
+// Remove the entry from the store. The lock must be held by the caller.
+func (this *MemoryStore) remove(el *list.Element) {
+	id := el.Value.(*memoryEntry).id
+	this.lru.Remove(el)
+	delete(this.m, id)
+	this.unindex(id)
+}
+
+// Remove the session ID from the sessions of its owner. The lock must be held by
+// the caller.
+func (this *MemoryStore) unindex(id string) {
+	owner, ok := this.owners[id]
+	if !ok {
+		return
+	}
+	delete(this.owners, id)
+	delete(this.unsaved, id)
+	delete(this.index[owner], id)
+	if len(this.index[owner]) == 0 {
+		delete(this.index, owner)
+	}
+}
+
+// Re-create the internal maps, dropping all existing sessions.
 func (this *MemoryStore) newMap() {
-	this.m = make(map[string]*Session, this.capc)
+	this.m = make(map[string]*list.Element, this.opts.Capacity)
+	this.lru = list.New()
+	this.index = make(map[string]map[string]struct{})
+	this.owners = make(map[string]string)
+	this.unsaved = make(map[string]time.Time)
+}
+
+// Get the time to live of the session in a store. If the maxAge is 0 (which means
+// browser-session lifetime), expire after browserTTL, or in a reasonable delay of
+// 2 days if it is 0. The weird case of a negative maxAge will cause the immediate
+// expiration.
+func sessionTTL(sess *Session, browserTTL time.Duration) time.Duration {
+	ttl := sess.MaxAge()
+	if ttl == 0 {
+		ttl = browserTTL
+		if ttl == 0 {
+			ttl = defaultBrowserTTL
+		}
+	}
+	return ttl
 }
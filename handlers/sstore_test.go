@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreEviction(t *testing.T) {
+	ms := NewMemoryStoreWithOptions(&MemoryStoreOptions{MaxLen: 2})
+	defer ms.Close()
+
+	s1, s2, s3 := newSession(0), newSession(0), newSession(0)
+	ms.Set(s1)
+	ms.Set(s2)
+	// Use s1, so that s2 is the least recently used
+	ms.Get(s1.ID())
+	ms.Set(s3)
+
+	assertTrue(ms.Len() == 2, fmt.Sprintf("expected store to have 2 sessions, got %d", ms.Len()), t)
+	ssn, _ := ms.Get(s2.ID())
+	assertTrue(ssn == nil, "expected least recently used session to be evicted", t)
+	ssn, _ = ms.Get(s1.ID())
+	assertTrue(ssn != nil && ssn.ID() == s1.ID(), "expected session 1 to be in the store", t)
+	ssn, _ = ms.Get(s3.ID())
+	assertTrue(ssn != nil && ssn.ID() == s3.ID(), "expected session 3 to be in the store", t)
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	ms := NewMemoryStoreWithOptions(&MemoryStoreOptions{SweepInterval: 10 * time.Millisecond})
+	defer ms.Close()
+
+	ms.Set(newSession(0))
+	ssn := newSession(0)
+	ssn.internalSession.MaxAge = 20 * time.Millisecond
+	ms.Set(ssn)
+	assertTrue(ms.Len() == 2, fmt.Sprintf("expected store to have 2 sessions, got %d", ms.Len()), t)
+	time.Sleep(50 * time.Millisecond)
+	assertTrue(ms.Len() == 1, fmt.Sprintf("expected expired session to be removed, got %d sessions", ms.Len()), t)
+}
+
+func TestMemoryStoreSweepUnsaved(t *testing.T) {
+	ms := NewMemoryStoreWithOptions(&MemoryStoreOptions{SweepInterval: 10 * time.Millisecond})
+	defer ms.Close()
+
+	saved, unsaved := newSession(0), newSession(0)
+	ms.Associate("me", unsaved.ID())
+	ms.Associate("me", saved.ID())
+	ms.Set(saved)
+	ok, _ := ms.IsOwner("me", unsaved.ID())
+	assertTrue(ok, "expected the unsaved session to be associated", t)
+	time.Sleep(50 * time.Millisecond)
+	ok, _ = ms.IsOwner("me", unsaved.ID())
+	assertTrue(!ok, "expected the association of the unsaved session to be removed", t)
+	ok, _ = ms.IsOwner("me", saved.ID())
+	assertTrue(ok, "expected the saved session to stay associated", t)
+	ms.l.Lock()
+	n := len(ms.owners)
+	ms.l.Unlock()
+	assertTrue(n == 1, fmt.Sprintf("expected 1 associated session, got %d", n), t)
+}
+
+func TestMemoryStoreClose(t *testing.T) {
+	ms := NewMemoryStoreWithOptions(&MemoryStoreOptions{SweepInterval: 10 * time.Millisecond})
+	ms.Close()
+	ms.Close()
+
+	ssn := newSession(0)
+	ssn.internalSession.MaxAge = 10 * time.Millisecond
+	ms.Set(ssn)
+	time.Sleep(30 * time.Millisecond)
+	assertTrue(ms.Len() == 1, fmt.Sprintf("expected expired session to be kept after Close, got %d sessions", ms.Len()), t)
+	got, _ := ms.Get(ssn.ID())
+	assertTrue(got == nil, "expected expired session to be nil", t)
+	assertTrue(ms.Len() == 0, fmt.Sprintf("expected expired session to be removed by Get, got %d sessions", ms.Len()), t)
+}
+
+func TestMemoryStoreCompareAndSet(t *testing.T) {
+	ms := NewMemoryStore(1)
+	defer ms.Close()
+
+	ssn := newSession(0)
+	ok, err := ms.CompareAndSet(ssn, 1)
+	assertTrue(!ok && err == nil, fmt.Sprintf("expected missing session to have version 0, got %v, %v", ok, err), t)
+	ssn.internalSession.Version = 1
+	ok, err = ms.CompareAndSet(ssn, 0)
+	assertTrue(ok && err == nil, fmt.Sprintf("expected new session to be saved, got %v, %v", ok, err), t)
+
+	// Two concurrent updates of version 1, only the first one is saved
+	s1, _ := ms.Get(ssn.ID())
+	s2, _ := ms.Get(ssn.ID())
+	s1.internalSession.Version, s2.internalSession.Version = 2, 2
+	s1.Set("foo", "bar")
+	s2.Set("foo", "baz")
+	ok, _ = ms.CompareAndSet(s1, 1)
+	assertTrue(ok, "expected first update to be saved", t)
+	ok, _ = ms.CompareAndSet(s2, 1)
+	assertTrue(!ok, "expected second update to be refused", t)
+	cur, _ := ms.Get(ssn.ID())
+	assertTrue(cur.Get("foo") == "bar", fmt.Sprintf("expected foo to be bar, got %v", cur.Get("foo")), t)
+	assertTrue(cur.Version() == 2, fmt.Sprintf("expected version 2, got %d", cur.Version()), t)
+}
@@ -0,0 +1,525 @@
+// Package storetest provides a conformance test suite for the implementations of
+// the handlers.SessionStore interface. The optional capabilities of the stores
+// (handlers.SessionToucher, handlers.SessionCompareAndSetter, handlers.SessionReplacer,
+// handlers.SessionIndexer and handlers.ContextSessionStore) are tested if they are
+// implemented.
+//
+// Usage, in the tests of a store:
+//
+//	func TestMyStore(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) handlers.SessionStore {
+//			return NewMyStore()
+//		})
+//	}
+package storetest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/ghost/handlers"
+)
+
+// Factory creates a new, empty store for a test of the suite. The store can be
+// closed using t.Cleanup.
+type Factory func(t *testing.T) handlers.SessionStore
+
+// The tests of the suite, in order.
+var tests = []struct {
+	name string
+	fn   func(*testing.T, handlers.SessionStore)
+}{
+	{"GetMissing", testGetMissing},
+	{"SetGet", testSetGet},
+	{"Overwrite", testOverwrite},
+	{"Delete", testDelete},
+	{"Clear", testClear},
+	{"Len", testLen},
+	{"Expires", testExpires},
+	{"Touch", testTouch},
+	{"CompareAndSet", testCompareAndSet},
+	{"Replace", testReplace},
+	{"Index", testIndex},
+	{"Context", testContext},
+	{"Concurrent", testConcurrent},
+}
+
+// Run runs the conformance suite, each test as a subtest with a new store created by
+// the factory. The tests of the expiration wait for more than a second (the time to
+// live of the stores is usually in seconds), they are skipped in short mode.
+func Run(t *testing.T, newStore Factory) {
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.fn(t, newStore(t))
+		})
+	}
+}
+
+// Create a new session with some data.
+func newSession(maxAge int) *handlers.Session {
+	sess := handlers.NewSession(maxAge)
+	sess.Set("string", "value")
+	sess.Set("other", "other value")
+	return sess
+}
+
+// Save the session in the store, and fail the test if there is an error.
+func mustSet(t *testing.T, st handlers.SessionStore, sess *handlers.Session) {
+	if err := st.Set(sess); err != nil {
+		t.Fatalf("Set: unexpected error: %s", err)
+	}
+}
+
+// Get the session from the store, and fail the test if there is an error.
+func mustGet(t *testing.T, st handlers.SessionStore, id string) *handlers.Session {
+	sess, err := st.Get(id)
+	if err != nil {
+		t.Fatalf("Get: unexpected error: %s", err)
+	}
+	return sess
+}
+
+// Check that the session was read back from the store as it was saved.
+func checkSame(exp, got *handlers.Session) error {
+	if got == nil {
+		return fmt.Errorf("expected session %s, got nil", exp.ID())
+	}
+	if got.ID() != exp.ID() {
+		return fmt.Errorf("expected ID %s, got %s", exp.ID(), got.ID())
+	}
+	if got.IsNew() {
+		return fmt.Errorf("expected session read from the store not to be new")
+	}
+	if got.MaxAge() != exp.MaxAge() {
+		return fmt.Errorf("expected max age %s, got %s", exp.MaxAge(), got.MaxAge())
+	}
+	if !got.Created().Equal(exp.Created()) {
+		return fmt.Errorf("expected creation time %s, got %s", exp.Created(), got.Created())
+	}
+	if !got.LastAccess().Equal(exp.LastAccess()) {
+		return fmt.Errorf("expected last access time %s, got %s", exp.LastAccess(), got.LastAccess())
+	}
+	if got.Version() != exp.Version() {
+		return fmt.Errorf("expected version %d, got %d", exp.Version(), got.Version())
+	}
+	if len(got.Data) != len(exp.Data) {
+		return fmt.Errorf("expected %d keys, got %d", len(exp.Data), len(got.Data))
+	}
+	for k, v := range exp.Data {
+		if got.Data[k] != v {
+			return fmt.Errorf("expected %s to be %v, got %v", k, v, got.Data[k])
+		}
+	}
+	return nil
+}
+
+func testGetMissing(t *testing.T, st handlers.SessionStore) {
+	if sess := mustGet(t, st, handlers.NewSession(0).ID()); sess != nil {
+		t.Errorf("expected missing session to be nil, got %v", sess)
+	}
+}
+
+func testSetGet(t *testing.T, st handlers.SessionStore) {
+	sess := newSession(3600)
+	mustSet(t, st, sess)
+	if err := checkSame(sess, mustGet(t, st, sess.ID())); err != nil {
+		t.Error(err)
+	}
+	// Browser session
+	sess = newSession(0)
+	mustSet(t, st, sess)
+	if err := checkSame(sess, mustGet(t, st, sess.ID())); err != nil {
+		t.Error(err)
+	}
+}
+
+func testOverwrite(t *testing.T, st handlers.SessionStore) {
+	sess := newSession(3600)
+	mustSet(t, st, sess)
+	sess.Set("string", "new value")
+	sess.Delete("other")
+	mustSet(t, st, sess)
+	if err := checkSame(sess, mustGet(t, st, sess.ID())); err != nil {
+		t.Error(err)
+	}
+}
+
+func testDelete(t *testing.T, st handlers.SessionStore) {
+	s1, s2 := newSession(3600), newSession(3600)
+	mustSet(t, st, s1)
+	mustSet(t, st, s2)
+	if err := st.Delete(s1.ID()); err != nil {
+		t.Fatalf("Delete: unexpected error: %s", err)
+	}
+	if sess := mustGet(t, st, s1.ID()); sess != nil {
+		t.Errorf("expected deleted session to be nil, got %v", sess)
+	}
+	if err := checkSame(s2, mustGet(t, st, s2.ID())); err != nil {
+		t.Error(err)
+	}
+	// Deleting a missing session is not an error
+	if err := st.Delete(s1.ID()); err != nil {
+		t.Errorf("Delete: expected no error for a missing session, got %s", err)
+	}
+}
+
+func testClear(t *testing.T, st handlers.SessionStore) {
+	var ids []string
+	for i := 0; i < 5; i++ {
+		sess := newSession(3600)
+		mustSet(t, st, sess)
+		ids = append(ids, sess.ID())
+	}
+	if err := st.Clear(); err != nil {
+		t.Fatalf("Clear: unexpected error: %s", err)
+	}
+	for _, id := range ids {
+		if sess := mustGet(t, st, id); sess != nil {
+			t.Errorf("expected cleared session %s to be nil", id)
+		}
+	}
+	if n := st.Len(); n > 0 {
+		t.Errorf("expected no session after Clear, got %d", n)
+	}
+}
+
+func testLen(t *testing.T, st handlers.SessionStore) {
+	if st.Len() < 0 {
+		t.Skip("Len is not supported by the store")
+	}
+	if n := st.Len(); n != 0 {
+		t.Fatalf("expected empty store, got %d sessions", n)
+	}
+	var sessions []*handlers.Session
+	for i := 0; i < 3; i++ {
+		sess := newSession(3600)
+		mustSet(t, st, sess)
+		sessions = append(sessions, sess)
+	}
+	// Saving again does not count twice
+	mustSet(t, st, sessions[0])
+	if n := st.Len(); n != 3 {
+		t.Errorf("expected 3 sessions, got %d", n)
+	}
+	st.Delete(sessions[1].ID())
+	if n := st.Len(); n != 2 {
+		t.Errorf("expected 2 sessions after Delete, got %d", n)
+	}
+}
+
+func testExpires(t *testing.T, st handlers.SessionStore) {
+	if testing.Short() {
+		t.Skip("expiration test skipped in short mode")
+	}
+	short, long := newSession(1), newSession(3600)
+	mustSet(t, st, short)
+	mustSet(t, st, long)
+	if sess := mustGet(t, st, short.ID()); sess == nil {
+		t.Fatalf("expected session to be in the store before it expires")
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if sess := mustGet(t, st, short.ID()); sess != nil {
+		t.Errorf("expected expired session to be nil, got %v", sess)
+	}
+	if err := checkSame(long, mustGet(t, st, long.ID())); err != nil {
+		t.Error(err)
+	}
+	if n := st.Len(); n > 1 {
+		t.Errorf("expected expired session not to be counted, got %d sessions", n)
+	}
+}
+
+func testTouch(t *testing.T, st handlers.SessionStore) {
+	tc, ok := st.(handlers.SessionToucher)
+	if !ok {
+		t.Skip("SessionToucher is not implemented by the store")
+	}
+	// The last access time is saved, but not the content
+	sess := newSession(3600)
+	mustSet(t, st, sess)
+	la := sess.LastAccess().Add(time.Minute)
+	touched := copySession(sess, func(m map[string]interface{}) {
+		m["LastAccess"] = la
+		m["Data"].(map[string]interface{})["string"] = "touched"
+	})
+	if err := tc.Touch(touched); err != nil {
+		t.Fatalf("Touch: unexpected error: %s", err)
+	}
+	if got := mustGet(t, st, sess.ID()); got == nil || got.Get("string") != "value" || !got.LastAccess().Equal(la) {
+		t.Errorf("expected touched session with its content and the new last access time, got %v", got)
+	}
+
+	if testing.Short() {
+		t.Skip("expiration test skipped in short mode")
+	}
+	sess = newSession(2)
+	mustSet(t, st, sess)
+	time.Sleep(1200 * time.Millisecond)
+	if err := tc.Touch(sess); err != nil {
+		t.Fatalf("Touch: unexpected error: %s", err)
+	}
+	time.Sleep(1200 * time.Millisecond)
+	if err := checkSame(sess, mustGet(t, st, sess.ID())); err != nil {
+		t.Errorf("expected touched session to be in the store: %s", err)
+	}
+	// Touching a missing session does not create it
+	missing := newSession(3600)
+	if err := tc.Touch(missing); err != nil {
+		t.Errorf("Touch: expected no error for a missing session, got %s", err)
+	}
+	if got := mustGet(t, st, missing.ID()); got != nil {
+		t.Errorf("expected touched missing session to be nil, got %v", got)
+	}
+}
+
+// Get a copy of the session with the specified version and value. The version can
+// only be changed by the SessionHandler, the copy is made through JSON.
+func withVersion(sess *handlers.Session, version int64, val string) *handlers.Session {
+	return copySession(sess, func(m map[string]interface{}) {
+		m["Version"] = version
+		m["Data"].(map[string]interface{})["string"] = val
+	})
+}
+
+// Get a copy of the session with the ID of another session, as if it was regenerated.
+func withID(sess *handlers.Session, id string) *handlers.Session {
+	return copySession(sess, func(m map[string]interface{}) {
+		m["ID"] = id
+	})
+}
+
+// Get a copy of the session through JSON, with the fields changed by fn.
+func copySession(sess *handlers.Session, fn func(map[string]interface{})) *handlers.Session {
+	b, err := json.Marshal(sess)
+	if err != nil {
+		panic(err)
+	}
+	var m map[string]interface{}
+	if err = json.Unmarshal(b, &m); err != nil {
+		panic(err)
+	}
+	fn(m)
+	if b, err = json.Marshal(m); err != nil {
+		panic(err)
+	}
+	c := new(handlers.Session)
+	if err = json.Unmarshal(b, c); err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func testCompareAndSet(t *testing.T, st handlers.SessionStore) {
+	cas, ok := st.(handlers.SessionCompareAndSetter)
+	if !ok {
+		t.Skip("SessionCompareAndSetter is not implemented by the store")
+	}
+	sess := newSession(3600)
+	if ok, err := cas.CompareAndSet(withVersion(sess, 1, "v1"), 1); err == handlers.ErrCompareAndSetUnsupported {
+		t.Skip("SessionCompareAndSetter is not supported by the wrapped store")
+	} else if ok || err != nil {
+		t.Errorf("expected missing session to have version 0, got %v, %v", ok, err)
+	}
+	if ok, err := cas.CompareAndSet(withVersion(sess, 1, "v1"), 0); !ok || err != nil {
+		t.Fatalf("expected new session to be saved, got %v, %v", ok, err)
+	}
+	// Two concurrent updates of version 1
+	if ok, err := cas.CompareAndSet(withVersion(sess, 2, "v2a"), 1); !ok || err != nil {
+		t.Errorf("expected first update to be saved, got %v, %v", ok, err)
+	}
+	if ok, err := cas.CompareAndSet(withVersion(sess, 2, "v2b"), 1); ok || err != nil {
+		t.Errorf("expected second update to be refused, got %v, %v", ok, err)
+	}
+	got := mustGet(t, st, sess.ID())
+	if got == nil || got.Version() != 2 || got.Get("string") != "v2a" {
+		t.Errorf("expected first update to be in the store, got %v", got)
+	}
+}
+
+func testReplace(t *testing.T, st handlers.SessionStore) {
+	rs, ok := st.(handlers.SessionReplacer)
+	if !ok {
+		t.Skip("SessionReplacer is not implemented by the store")
+	}
+	sess := newSession(3600)
+	if ok, err := rs.Replace(sess, sess.ID()); ok || err != nil {
+		t.Errorf("expected missing session not to be saved, got %v, %v", ok, err)
+	}
+	if got := mustGet(t, st, sess.ID()); got != nil {
+		t.Fatalf("expected missing session not to be created, got %v", got)
+	}
+	mustSet(t, st, sess)
+	sess.Set("string", "new value")
+	if ok, err := rs.Replace(sess, sess.ID()); !ok || err != nil {
+		t.Fatalf("expected existing session to be saved, got %v, %v", ok, err)
+	}
+	if err := checkSame(sess, mustGet(t, st, sess.ID())); err != nil {
+		t.Error(err)
+	}
+
+	// Move to a new ID
+	moved := withID(sess, handlers.NewSession(0).ID())
+	if ok, err := rs.Replace(moved, sess.ID()); !ok || err != nil {
+		t.Fatalf("expected session to be moved, got %v, %v", ok, err)
+	}
+	if got := mustGet(t, st, sess.ID()); got != nil {
+		t.Errorf("expected old ID to be deleted, got %v", got)
+	}
+	if err := checkSame(moved, mustGet(t, st, moved.ID())); err != nil {
+		t.Error(err)
+	}
+	// The old ID is gone, it cannot be moved again
+	again := withID(sess, handlers.NewSession(0).ID())
+	if ok, err := rs.Replace(again, sess.ID()); ok || err != nil {
+		t.Errorf("expected deleted session not to be moved, got %v, %v", ok, err)
+	}
+	if got := mustGet(t, st, again.ID()); got != nil {
+		t.Errorf("expected deleted session not to be created, got %v", got)
+	}
+}
+
+func testIndex(t *testing.T, st handlers.SessionStore) {
+	idx, ok := st.(handlers.SessionIndexer)
+	if !ok {
+		t.Skip("SessionIndexer is not implemented by the store")
+	}
+	s1, s2, s3 := newSession(3600), newSession(3600), newSession(3600)
+	for _, sess := range []*handlers.Session{s1, s2, s3} {
+		mustSet(t, st, sess)
+	}
+	idx.Associate("me", s1.ID())
+	idx.Associate("me", s2.ID())
+	idx.Associate("you", s3.ID())
+	exp := []string{s1.ID(), s2.ID()}
+	sort.Strings(exp)
+	ids, err := idx.OwnerSessions("me")
+	if err != nil || fmt.Sprint(ids) != fmt.Sprint(exp) {
+		t.Errorf("expected sessions %v, got %v, %v", exp, ids, err)
+	}
+	// A deleted session is not listed
+	st.Delete(s2.ID())
+	ids, err = idx.OwnerSessions("me")
+	if err != nil || len(ids) != 1 || ids[0] != s1.ID() {
+		t.Errorf("expected session %s, got %v, %v", s1.ID(), ids, err)
+	}
+	// A session associated before it is saved is listed once saved
+	s4 := newSession(3600)
+	idx.Associate("me", s4.ID())
+	if ids, err = idx.OwnerSessions("me"); err != nil || len(ids) != 1 {
+		t.Errorf("expected 1 session, got %v, %v", ids, err)
+	}
+	if own, err := idx.IsOwner("me", s4.ID()); !own || err != nil {
+		t.Errorf("expected unsaved session to be associated with the owner, got %v, %v", own, err)
+	}
+	if own, err := idx.IsOwner("you", s4.ID()); own || err != nil {
+		t.Errorf("expected session not to be associated with the other owner, got %v, %v", own, err)
+	}
+	mustSet(t, st, s4)
+	if ids, err = idx.OwnerSessions("me"); err != nil || len(ids) != 2 {
+		t.Errorf("expected 2 sessions, got %v, %v", ids, err)
+	}
+	if err = idx.DeleteOwnerSessions("me"); err != nil {
+		t.Fatalf("DeleteOwnerSessions: unexpected error: %s", err)
+	}
+	if sess := mustGet(t, st, s4.ID()); sess != nil {
+		t.Errorf("expected session of the owner to be deleted, got %v", sess)
+	}
+	if own, err := idx.IsOwner("me", s1.ID()); own || err != nil {
+		t.Errorf("expected session not to be associated after the delete, got %v, %v", own, err)
+	}
+	if sess := mustGet(t, st, s1.ID()); sess != nil {
+		t.Errorf("expected session of the owner to be deleted, got %v", sess)
+	}
+	if ids, _ = idx.OwnerSessions("me"); len(ids) != 0 {
+		t.Errorf("expected no session for the owner, got %v", ids)
+	}
+	if err := checkSame(s3, mustGet(t, st, s3.ID())); err != nil {
+		t.Errorf("expected session of the other owner to be kept: %s", err)
+	}
+}
+
+func testContext(t *testing.T, st handlers.SessionStore) {
+	cs, ok := st.(handlers.ContextSessionStore)
+	if !ok {
+		t.Skip("ContextSessionStore is not implemented by the store")
+	}
+	ctx := context.Background()
+	sess := newSession(3600)
+	if err := cs.SetContext(ctx, sess); err != nil {
+		t.Fatalf("SetContext: unexpected error: %s", err)
+	}
+	got, err := cs.GetContext(ctx, sess.ID())
+	if err != nil {
+		t.Fatalf("GetContext: unexpected error: %s", err)
+	}
+	if err = checkSame(sess, got); err != nil {
+		t.Error(err)
+	}
+
+	// A cancelled context fails the operations
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err = cs.GetContext(cctx, sess.ID()); err == nil {
+		t.Errorf("GetContext: expected error with a cancelled context, got nil")
+	}
+	if err = cs.DeleteContext(cctx, sess.ID()); err == nil {
+		t.Errorf("DeleteContext: expected error with a cancelled context, got nil")
+	}
+
+	if err = cs.DeleteContext(ctx, sess.ID()); err != nil {
+		t.Fatalf("DeleteContext: unexpected error: %s", err)
+	}
+	if got, _ = cs.GetContext(ctx, sess.ID()); got != nil {
+		t.Errorf("expected deleted session to be nil, got %v", got)
+	}
+}
+
+func testConcurrent(t *testing.T, st handlers.SessionStore) {
+	const (
+		goroutines = 20
+		iterations = 10
+	)
+	var wg sync.WaitGroup
+	errs := make(chan error, goroutines)
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sess := newSession(3600)
+			for j := 0; j < iterations; j++ {
+				sess.Set("string", fmt.Sprint(j))
+				if err := st.Set(sess); err != nil {
+					errs <- err
+					return
+				}
+				got, err := st.Get(sess.ID())
+				if err == nil {
+					err = checkSame(sess, got)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				st.Len()
+			}
+			if err := st.Delete(sess.ID()); err != nil {
+				errs <- err
+				return
+			}
+			if got, err := st.Get(sess.ID()); err != nil || got != nil {
+				errs <- fmt.Errorf("expected deleted session to be nil, got %v, %v", got, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}